@@ -0,0 +1,321 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/keur/chillmailer/datastore"
+	"github.com/keur/chillmailer/mailer"
+	"github.com/keur/chillmailer/util"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// publicListID looks up a list whose archive is public. Private and missing
+// lists get the same 404, so the archive doesn't reveal which lists exist.
+func publicListID(w http.ResponseWriter, ds datastore.Datastore, listName string) (int, bool) {
+	listID, err := ds.GetMailingListID(listName)
+	if err != nil {
+		util.ServerError(w, err)
+		return 0, false
+	}
+	public := false
+	if listID != datastore.MailingListNoExist {
+		if public, err = ds.IsListArchivePublic(listID); err != nil {
+			util.ServerError(w, err)
+			return 0, false
+		}
+	}
+	if !public {
+		util.NotFound(w, "Archive not found")
+		return 0, false
+	}
+	return listID, true
+}
+
+// PublicBlast is a sent blast as shown in the public archive.
+type PublicBlast struct {
+	ID       int
+	Subject  string
+	TimeSent time.Time
+	HTML     string
+}
+
+func publicBlast(blast datastore.Blast) (PublicBlast, error) {
+	subject, html, err := mailer.RenderPublicCopy(blast.Subject, blast.Body, blast.ListName)
+	// Prefer the copy kept when the blast was sent, in case rendering has changed since
+	if blast.HTML != "" {
+		html, err = blast.HTML, nil
+	}
+	if err != nil {
+		return PublicBlast{}, err
+	}
+	timeSent := blast.TimeSent
+	if timeSent.IsZero() {
+		timeSent = blast.SendAt
+	}
+	return PublicBlast{ID: blast.ID, Subject: subject, TimeSent: timeSent, HTML: html}, nil
+}
+
+func publicBlasts(ds datastore.Datastore, listID int) ([]PublicBlast, error) {
+	blasts, err := ds.QueryListSentBlasts(listID)
+	if err != nil {
+		return nil, err
+	}
+	var public []PublicBlast
+	for _, blast := range blasts {
+		// Blasts aborted partway only stay in the admin archive
+		if blast.Status != datastore.BlastSent {
+			continue
+		}
+		// One blast that won't render shouldn't take the whole archive down
+		p, err := publicBlast(blast)
+		if err != nil {
+			continue
+		}
+		public = append(public, p)
+	}
+	return public, nil
+}
+
+type PublicArchiveData struct {
+	ListName string
+	Blasts   []PublicBlast
+}
+
+func servePublicArchive(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listName := chi.URLParam(r, "listName")
+		listID, ok := publicListID(w, ds, listName)
+		if !ok {
+			return
+		}
+		blasts, err := publicBlasts(ds, listID)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+
+		pageData := PublicArchiveData{ListName: listName, Blasts: blasts}
+		tmpl, err := util.NewTemplate("public_archive.html")
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if err = tmpl.Execute(w, &pageData); err != nil {
+			util.ServerError(w, err)
+			return
+		}
+	})
+}
+
+// blastGoesToList reports whether the list is one of those the blast goes to.
+func blastGoesToList(ds datastore.Datastore, blastID int, listID int) (bool, error) {
+	lists, err := ds.QueryBlastLists(blastID)
+	if err != nil {
+		return false, err
+	}
+	for _, list := range lists {
+		if list.ListID == listID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type PublicBlastData struct {
+	ListName string
+	Blast    PublicBlast
+}
+
+func servePublicBlast(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listName := chi.URLParam(r, "listName")
+		listID, ok := publicListID(w, ds, listName)
+		if !ok {
+			return
+		}
+		blastID, err := blastIDParam(r)
+		if err != nil {
+			util.UserError(w, err.Error())
+			return
+		}
+		blast, err := ds.GetBlast(blastID)
+		if err == sql.ErrNoRows || (err == nil && blast.Status != datastore.BlastSent) {
+			util.NotFound(w, "Blast not found")
+			return
+		} else if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		sentToList, err := blastGoesToList(ds, blastID, listID)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if !sentToList {
+			util.NotFound(w, "Blast not found")
+			return
+		}
+		public, err := publicBlast(blast)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+
+		pageData := PublicBlastData{ListName: listName, Blast: public}
+		tmpl, err := util.NewTemplate("public_blast.html")
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if err = tmpl.Execute(w, &pageData); err != nil {
+			util.ServerError(w, err)
+			return
+		}
+	})
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Links   []atomLink  `xml:"link"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Link    atomLink    `xml:"link"`
+	Updated string      `xml:"updated"`
+	Content atomContent `xml:"content"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+func servePublicFeed(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listName := chi.URLParam(r, "listName")
+		listID, ok := publicListID(w, ds, listName)
+		if !ok {
+			return
+		}
+		blasts, err := publicBlasts(ds, listID)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+
+		archiveLink := util.GetWebRoot(r) + filepath.Join("/archive", listName)
+		feed := atomFeed{
+			Title: listName,
+			ID:    archiveLink,
+			Links: []atomLink{
+				{Href: archiveLink},
+				{Href: archiveLink + "/feed.atom", Rel: "self"},
+			},
+			Author: atomAuthor{Name: listName},
+		}
+		updated := time.Time{}
+		for _, blast := range blasts {
+			link := archiveLink + "/" + strconv.Itoa(blast.ID)
+			feed.Entries = append(feed.Entries, atomEntry{
+				Title:   blast.Subject,
+				ID:      link,
+				Link:    atomLink{Href: link},
+				Updated: blast.TimeSent.UTC().Format(time.RFC3339),
+				Content: atomContent{Type: "html", Body: blast.HTML},
+			})
+			if blast.TimeSent.After(updated) {
+				updated = blast.TimeSent
+			}
+		}
+		feed.Updated = updated.UTC().Format(time.RFC3339)
+
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		if _, err = w.Write([]byte(xml.Header)); err != nil {
+			return
+		}
+		if err = xml.NewEncoder(w).Encode(&feed); err != nil {
+			util.ServerError(w, err)
+			return
+		}
+	})
+}
+
+func serveSetArchiveVisibility(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listName := chi.URLParam(r, "listName")
+		err := r.ParseForm()
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		listID, err := ds.GetMailingListID(listName)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if listID == datastore.MailingListNoExist {
+			util.UserError(w, fmt.Sprintf("Provided invalid mailing list: %s", listName))
+			return
+		}
+
+		public := util.FormValue(r, "public") == "on"
+		if err = ds.SetListArchivePublic(listID, public); err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		redirectLink := filepath.Join("/admin/list/display/", listName)
+		http.Redirect(w, r, redirectLink, http.StatusSeeOther)
+	})
+}
+
+// serveWebVersion shows a blast as it was sent, to anyone with its link. It
+// works whether or not the list's archive is public.
+func serveWebVersion(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blast, err := ds.GetBlastByPublicID(chi.URLParam(r, "publicID"))
+		if err != nil {
+			blastError(w, err)
+			return
+		}
+		public, err := publicBlast(blast)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		layout, err := mailer.ListLayout(ds, blast.ListID)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		page, err := mailer.RenderWebVersion(public.Subject, public.HTML, layout)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(page))
+	})
+}
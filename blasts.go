@@ -0,0 +1,314 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/keur/chillmailer/datastore"
+	"github.com/keur/chillmailer/mailer"
+	"github.com/keur/chillmailer/util"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+)
+
+var errNoSendTime = errors.New("No send time provided")
+
+// parseSendAt reads the requested send time from a form. API clients can pass
+// send_at as RFC 3339, while the admin UI sends send_date, send_time and
+// timezone separately. Without either we fall back to the given time, which
+// is taken as is so that a zero grace period sends right away.
+func parseSendAt(r *http.Request, fallback time.Time) (time.Time, error) {
+	var sendAt time.Time
+	var err error
+	if raw := util.FormValue(r, "send_at"); raw != "" {
+		sendAt, err = time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return time.Time{}, errors.New(fmt.Sprintf("Provided invalid send_at: %s", raw))
+		}
+	} else if date := util.FormValue(r, "send_date"); date != "" {
+		clock := util.FormValue(r, "send_time")
+		if clock == "" {
+			clock = "00:00"
+		}
+		zone := util.FormValue(r, "timezone")
+		if zone == "" {
+			zone = "UTC"
+		}
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			return time.Time{}, errors.New(fmt.Sprintf("Provided invalid timezone: %s", zone))
+		}
+		sendAt, err = time.ParseInLocation("2006-01-02 15:04", date+" "+clock, loc)
+		if err != nil {
+			return time.Time{}, errors.New(fmt.Sprintf("Provided invalid send date or time: %s %s", date, clock))
+		}
+	} else if fallback.IsZero() {
+		return time.Time{}, errNoSendTime
+	} else {
+		return fallback, nil
+	}
+
+	if sendAt.Before(time.Now()) {
+		return time.Time{}, errors.New("Send time must be in the future")
+	}
+	return sendAt, nil
+}
+
+func blastIDParam(r *http.Request) (int, error) {
+	raw := chi.URLParam(r, "blastID")
+	blastID, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Provided invalid blast: %s", raw))
+	}
+	return blastID, nil
+}
+
+func blastError(w http.ResponseWriter, err error) {
+	if err == sql.ErrNoRows {
+		util.NotFound(w, "Blast not found")
+	} else if err == mailer.ErrBlastNotPending {
+		util.UserError(w, err.Error())
+	} else {
+		util.ServerError(w, err)
+	}
+}
+
+// redirectBack returns to the page the blast action was taken from, which is
+// either a list page or the scheduled blasts view.
+func redirectBack(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Referer") == "" {
+		http.Redirect(w, r, "/admin/scheduled", http.StatusSeeOther)
+		return
+	}
+	util.GoBackWhereYouCameFrom(w, r)
+}
+
+// BlastView is a blast along with how far it has got.
+type BlastView struct {
+	datastore.Blast
+	Progress datastore.BlastProgress
+}
+
+func blastViews(ds datastore.Datastore, blasts []datastore.Blast) ([]BlastView, error) {
+	views := make([]BlastView, len(blasts))
+	for i, blast := range blasts {
+		progress, err := ds.QueryBlastProgress(blast.ID)
+		if err != nil {
+			return nil, err
+		}
+		views[i] = BlastView{Blast: blast, Progress: progress}
+	}
+	return views, nil
+}
+
+type ScheduledBlastsData struct {
+	Blasts []datastore.Blast
+}
+
+func serveScheduledBlasts(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blasts, err := ds.QueryBlastsByStatus(datastore.BlastScheduled, datastore.BlastPaused)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		tmpl, err := util.NewTemplate("scheduled.html")
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if err = tmpl.Execute(w, &ScheduledBlastsData{Blasts: blasts}); err != nil {
+			util.ServerError(w, err)
+			return
+		}
+	})
+}
+
+func serveCancelBlast(logger *zerolog.Logger, scheduler *mailer.Scheduler) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blastID, err := blastIDParam(r)
+		if err != nil {
+			util.UserError(w, err.Error())
+			return
+		}
+		logger.Info().Msgf("Cancelling blast %d", blastID)
+		if err = scheduler.Cancel(blastID); err != nil {
+			blastError(w, err)
+			return
+		}
+		redirectBack(w, r)
+	})
+}
+
+func serveSendBlastNow(logger *zerolog.Logger, scheduler *mailer.Scheduler) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blastID, err := blastIDParam(r)
+		if err != nil {
+			util.UserError(w, err.Error())
+			return
+		}
+		logger.Info().Msgf("Sending blast %d now", blastID)
+		if err = scheduler.SendNow(blastID); err != nil {
+			blastError(w, err)
+			return
+		}
+		redirectBack(w, r)
+	})
+}
+
+func servePauseBlast(logger *zerolog.Logger, scheduler *mailer.Scheduler) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blastID, err := blastIDParam(r)
+		if err != nil {
+			util.UserError(w, err.Error())
+			return
+		}
+		logger.Info().Msgf("Pausing blast %d", blastID)
+		if err = scheduler.Pause(blastID); err != nil {
+			blastError(w, err)
+			return
+		}
+		redirectBack(w, r)
+	})
+}
+
+func serveResumeBlast(logger *zerolog.Logger, scheduler *mailer.Scheduler) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blastID, err := blastIDParam(r)
+		if err != nil {
+			util.UserError(w, err.Error())
+			return
+		}
+		logger.Info().Msgf("Resuming blast %d", blastID)
+		if err = scheduler.Resume(blastID); err != nil {
+			blastError(w, err)
+			return
+		}
+		redirectBack(w, r)
+	})
+}
+
+type BlastStatusData struct {
+	ID       int                   `json:"id"`
+	ListName string                `json:"list_name"`
+	Subject  string                `json:"subject"`
+	Status   datastore.BlastStatus `json:"status"`
+	SendAt   time.Time             `json:"send_at"`
+	Total    int                   `json:"total"`
+	Sent     int                   `json:"sent"`
+	Failed   int                   `json:"failed"`
+	Pending  int                   `json:"pending"`
+}
+
+func serveBlastStatus(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blastID, err := blastIDParam(r)
+		if err != nil {
+			util.UserError(w, err.Error())
+			return
+		}
+		blast, err := ds.GetBlast(blastID)
+		if err != nil {
+			blastError(w, err)
+			return
+		}
+		progress, err := ds.QueryBlastProgress(blastID)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		util.WriteJSON(w, &BlastStatusData{
+			ID:       blast.ID,
+			ListName: blast.ListName,
+			Subject:  blast.Subject,
+			Status:   blast.Status,
+			SendAt:   blast.SendAt,
+			Total:    progress.Total,
+			Sent:     progress.Sent,
+			Failed:   progress.Failed,
+			Pending:  progress.Pending,
+		})
+	})
+}
+
+func serveRescheduleBlast(logger *zerolog.Logger, scheduler *mailer.Scheduler) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blastID, err := blastIDParam(r)
+		if err != nil {
+			util.UserError(w, err.Error())
+			return
+		}
+		if err = r.ParseForm(); err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		sendAt, err := parseSendAt(r, time.Time{})
+		if err != nil {
+			util.UserError(w, err.Error())
+			return
+		}
+		logger.Info().Msgf("Rescheduling blast %d for %s", blastID, sendAt)
+		if err = scheduler.Reschedule(blastID, sendAt); err != nil {
+			blastError(w, err)
+			return
+		}
+		http.Redirect(w, r, "/admin/scheduled", http.StatusSeeOther)
+	})
+}
+
+func serveEditBlast(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blastID, err := blastIDParam(r)
+		if err != nil {
+			util.UserError(w, err.Error())
+			return
+		}
+		if err = r.ParseForm(); err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		subject := util.FormValue(r, "subject")
+		body := util.FormValue(r, "body")
+		if subject == "" || body == "" {
+			util.UserError(w, "Provided invalid form data")
+			return
+		}
+		blast, err := ds.GetBlast(blastID)
+		if err != nil {
+			blastError(w, err)
+			return
+		}
+		if !mailer.IsPending(blast.Status) {
+			blastError(w, mailer.ErrBlastNotPending)
+			return
+		}
+		lists, err := ds.QueryBlastLists(blastID)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		listIDs := make([]int, len(lists))
+		for i, list := range lists {
+			listIDs[i] = list.ListID
+		}
+		sample, err := sampleMergeData(ds, blast.ListName, listIDs...)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if _, err = mailer.ParseMergeTags(subject, body, sample); err != nil {
+			util.UserError(w, err.Error())
+			return
+		}
+		if err = ds.UpdateBlastContent(blastID, subject, body); err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		http.Redirect(w, r, "/admin/scheduled", http.StatusSeeOther)
+	})
+}
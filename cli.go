@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/keur/chillmailer/datastore"
+)
+
+// runCommand runs one of the command line tools instead of the web server,
+// such as: chillmailer import -list news subscribers.csv
+func runCommand(ds datastore.Datastore, args []string, stdout io.Writer) error {
+	switch args[0] {
+	case "import":
+		return runImport(ds, args[1:], stdout)
+	case "export":
+		return runExport(ds, args[1:], stdout)
+	default:
+		return errors.New(fmt.Sprintf("Unknown command %s, use import or export", args[0]))
+	}
+}
+
+func runImport(ds datastore.Datastore, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	listName := flags.String("list", "", "mailing list to import into")
+	mapping := flags.String("map", "", "column mapping as header=target pairs separated by commas")
+	delimiter := flags.String("delimiter", "", "comma or tab, guessed from the header when not given")
+	dryRun := flags.Bool("dry-run", false, "check the file without importing anything")
+	reportFile := flags.String("report", "", "write the rejected rows as CSV to this file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *listName == "" || flags.NArg() != 1 {
+		return errors.New("Usage: chillmailer import -list <name> [flags] <file>")
+	}
+
+	listID, err := ds.GetMailingListID(*listName)
+	if err != nil {
+		return err
+	}
+	if listID == datastore.MailingListNoExist {
+		return errors.New(fmt.Sprintf("No mailing list named %s", *listName))
+	}
+	opts := ImportOptions{DryRun: *dryRun}
+	switch *delimiter {
+	case "comma":
+		opts.Delimiter = ','
+	case "tab":
+		opts.Delimiter = '\t'
+	case "":
+		if strings.EqualFold(filepath.Ext(flags.Arg(0)), ".tsv") {
+			opts.Delimiter = '\t'
+		}
+	default:
+		return errors.New(fmt.Sprintf("Invalid delimiter %s, use comma or tab", *delimiter))
+	}
+	if opts.Mapping, err = ParseImportMapping(*mapping); err != nil {
+		return err
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	result, err := importSubscribers(ds, listID, file, opts)
+	if err != nil && result.Total > 0 {
+		return errors.New(fmt.Sprintf("Import stopped after %d rows, %d imported: %s", result.Total, result.Imported, err))
+	} else if err != nil {
+		return err
+	}
+
+	if opts.DryRun {
+		fmt.Fprintf(stdout, "Dry run: %d of %d rows would be imported, %d rejected\n", result.Imported, result.Total, len(result.Rejected))
+	} else {
+		fmt.Fprintf(stdout, "Imported %d of %d rows, %d rejected\n", result.Imported, result.Total, len(result.Rejected))
+	}
+	if *reportFile != "" {
+		report, err := os.Create(*reportFile)
+		if err != nil {
+			return err
+		}
+		defer report.Close()
+		return result.Report(report)
+	}
+	for _, r := range result.Rejected {
+		fmt.Fprintf(stdout, "Row %d %s: %s\n", r.Row, r.Email, r.Reason)
+	}
+	return nil
+}
+
+func runExport(ds datastore.Datastore, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	listName := flags.String("list", "", "mailing list to export, every list when not given")
+	rawFormat := flags.String("format", "csv", "csv or json")
+	withTokens := flags.Bool("tokens", false, "include unsubscribe tokens")
+	outFile := flags.String("o", "", "write to this file instead of standard output")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return errors.New("Usage: chillmailer export [-list <name>] [-format csv|json] [-tokens] [-o <file>]")
+	}
+	format, err := parseExportFormat(*rawFormat)
+	if err != nil {
+		return err
+	}
+	listIDs, err := exportListIDs(ds, *listName)
+	if err != nil {
+		return err
+	}
+
+	out := stdout
+	if *outFile != "" {
+		file, err := os.Create(*outFile)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	buffered := bufio.NewWriter(out)
+	if err = exportSubscribers(ds, listIDs, format, *withTokens, buffered); err != nil {
+		return err
+	}
+	return buffered.Flush()
+}
@@ -0,0 +1,261 @@
+package datastore
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type BlastStatus string
+
+const (
+	BlastScheduled BlastStatus = "scheduled"
+	BlastPaused    BlastStatus = "paused"
+	BlastSending   BlastStatus = "sending"
+	BlastSent      BlastStatus = "sent"
+	BlastCancelled BlastStatus = "cancelled"
+)
+
+type Blast struct {
+	ID       int
+	ListID   int
+	ListName string
+	Subject  string
+	Body     string
+	// WebRoot is the public address of the server, used to build links in the email
+	WebRoot     string
+	Status      BlastStatus
+	SendAt      time.Time
+	TimeCreated time.Time
+	// Author is the admin who enqueued the blast
+	Author string
+	// PublicID is the unguessable ID of the blast's web version
+	PublicID string
+	// SegmentID is zero when the blast goes to the whole list
+	SegmentID   int
+	SegmentName string
+	// OtherLists names the blast's other lists, comma separated, for display
+	OtherLists string
+
+	// Set once the blast has been sent, for the archive
+	HTML       string
+	Recipients int
+	TimeSent   time.Time
+	// Unsubscribes counts the recipients who left from the blast's unsubscribe link
+	Unsubscribes int
+	// LastError is why the blast was paused when it couldn't send, if it was
+	LastError string
+}
+
+// UnsubscribeRate is the share of recipients who unsubscribed from the blast,
+// as a percentage.
+func (b Blast) UnsubscribeRate() string {
+	if b.Recipients == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(b.Unsubscribes)/float64(b.Recipients))
+}
+
+const blastColumns = `
+    b.id, b.list_id, ml.name, b.subject, b.body, b.web_root, b.status, b.send_at, b.time_created,
+    COALESCE(b.author, ''), b.public_id, COALESCE(b.html, ''), COALESCE(b.recipient_count, 0), b.time_sent,
+    COALESCE(b.segment_id, 0), COALESCE(sg.name, ''),
+    COALESCE((SELECT group_concat(name, ', ') FROM (
+        SELECT ml2.name FROM blast_lists bl2 JOIN mailing_list ml2 ON ml2.id = bl2.list_id
+        WHERE bl2.blast_id = b.id AND bl2.position > 0 ORDER BY bl2.position)), ''),
+    (SELECT COUNT(*) FROM subscriptions WHERE unsub_blast_id = b.id), COALESCE(b.last_error, '')
+    FROM blasts b
+    JOIN mailing_list ml ON ml.id = b.list_id
+    LEFT JOIN segments sg ON sg.id = b.segment_id
+`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanBlast(row scanner) (Blast, error) {
+	var b Blast
+	var timeSent sql.NullTime
+	err := row.Scan(&b.ID, &b.ListID, &b.ListName, &b.Subject, &b.Body, &b.WebRoot, &b.Status, &b.SendAt, &b.TimeCreated,
+		&b.Author, &b.PublicID, &b.HTML, &b.Recipients, &timeSent, &b.SegmentID, &b.SegmentName, &b.OtherLists, &b.Unsubscribes, &b.LastError)
+	b.TimeSent = timeSent.Time
+	return b, err
+}
+
+func (sq *Sqlite) queryBlasts(query string, args ...any) ([]Blast, error) {
+	rows, err := sq.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blasts []Blast
+	for rows.Next() {
+		b, err := scanBlast(rows)
+		if err != nil {
+			return nil, err
+		}
+		blasts = append(blasts, b)
+	}
+	return blasts, rows.Err()
+}
+
+// CreateBlast schedules a blast to the lists, or to a segment of the first
+// when segmentID isn't zero. The first list is the blast's own, whose layout,
+// sender and settings it uses.
+func (sq *Sqlite) CreateBlast(listIDs []int, segmentID int, subject string, body string, webRoot string, author string, sendAt time.Time) (int, error) {
+	if len(listIDs) == 0 {
+		return 0, errors.New("A blast needs at least one list")
+	}
+	publicID, err := uuid.NewRandom()
+	if err != nil {
+		return 0, err
+	}
+	var segment sql.NullInt64
+	if segmentID != 0 {
+		segment = sql.NullInt64{Int64: int64(segmentID), Valid: true}
+	}
+
+	tx, err := sq.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO blasts (list_id, segment_id, subject, body, web_root, status, send_at, author, public_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		listIDs[0], segment, subject, body, webRoot, BlastScheduled, sendAt.UTC(), author, publicID.String())
+	if err != nil {
+		return 0, err
+	}
+	lastInsertID, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	for position, listID := range listIDs {
+		_, err = tx.Exec("INSERT INTO blast_lists (blast_id, list_id, position) VALUES (?, ?, ?)", lastInsertID, listID, position)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return int(lastInsertID), tx.Commit()
+}
+
+// BlastList is one of the lists a blast goes to.
+type BlastList struct {
+	ListID   int
+	ListName string
+}
+
+// QueryBlastLists returns the lists a blast goes to, its own list first.
+func (sq *Sqlite) QueryBlastLists(blastID int) ([]BlastList, error) {
+	rows, err := sq.Query(`
+      SELECT bl.list_id, ml.name
+      FROM blast_lists bl
+      JOIN mailing_list ml ON ml.id = bl.list_id
+      WHERE bl.blast_id = ?
+      ORDER BY bl.position
+  `, blastID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lists []BlastList
+	for rows.Next() {
+		var l BlastList
+		if err = rows.Scan(&l.ListID, &l.ListName); err != nil {
+			return nil, err
+		}
+		lists = append(lists, l)
+	}
+	return lists, rows.Err()
+}
+
+// GetBlast returns sql.ErrNoRows when no blast has the given ID.
+func (sq *Sqlite) GetBlast(blastID int) (Blast, error) {
+	return scanBlast(sq.QueryRow("SELECT"+blastColumns+"WHERE b.id = ?", blastID))
+}
+
+// GetBlastByPublicID returns sql.ErrNoRows when no blast has the given public ID.
+func (sq *Sqlite) GetBlastByPublicID(publicID string) (Blast, error) {
+	return scanBlast(sq.QueryRow("SELECT"+blastColumns+"WHERE b.public_id = ?", publicID))
+}
+
+// statusFilter builds an IN clause matching any of the given statuses.
+func statusFilter(statuses []BlastStatus) (string, []any) {
+	placeholders := make([]string, len(statuses))
+	args := make([]any, len(statuses))
+	for i, status := range statuses {
+		placeholders[i] = "?"
+		args[i] = status
+	}
+	return "b.status IN (" + strings.Join(placeholders, ", ") + ")", args
+}
+
+func (sq *Sqlite) QueryBlastsByStatus(statuses ...BlastStatus) ([]Blast, error) {
+	filter, args := statusFilter(statuses)
+	return sq.queryBlasts("SELECT"+blastColumns+"WHERE "+filter+" ORDER BY b.send_at", args...)
+}
+
+// sentToList matches blasts going to the list, whether it is their own or not.
+const sentToList = "EXISTS (SELECT 1 FROM blast_lists bl WHERE bl.blast_id = b.id AND bl.list_id = ?)"
+
+func (sq *Sqlite) QueryListBlastsByStatus(listID int, statuses ...BlastStatus) ([]Blast, error) {
+	filter, args := statusFilter(statuses)
+	return sq.queryBlasts("SELECT"+blastColumns+"WHERE "+sentToList+" AND "+filter+" ORDER BY b.send_at", append([]any{listID}, args...)...)
+}
+
+// QueryOwnBlastsByStatus is like QueryListBlastsByStatus, but leaves out blasts
+// from other lists that also go to this one.
+func (sq *Sqlite) QueryOwnBlastsByStatus(listID int, statuses ...BlastStatus) ([]Blast, error) {
+	filter, args := statusFilter(statuses)
+	return sq.queryBlasts("SELECT"+blastColumns+"WHERE b.list_id = ? AND "+filter+" ORDER BY b.send_at", append([]any{listID}, args...)...)
+}
+
+// QueryListSentBlasts returns the list's archive, newest first. Blasts
+// cancelled partway through are included once archived.
+func (sq *Sqlite) QueryListSentBlasts(listID int) ([]Blast, error) {
+	return sq.queryBlasts("SELECT"+blastColumns+"WHERE "+sentToList+" AND (b.status = ? OR (b.status = ? AND b.time_sent IS NOT NULL)) ORDER BY b.time_sent DESC",
+		listID, BlastSent, BlastCancelled)
+}
+
+// ArchiveBlast records what a finished blast looked like and how many it reached.
+func (sq *Sqlite) ArchiveBlast(blastID int, html string, recipients int, timeSent time.Time) error {
+	_, err := sq.Exec("UPDATE blasts SET html = ?, recipient_count = ?, time_sent = ? WHERE id = ?", html, recipients, timeSent.UTC(), blastID)
+	return err
+}
+
+func (sq *Sqlite) UpdateBlastContent(blastID int, subject string, body string) error {
+	_, err := sq.Exec("UPDATE blasts SET subject = ?, body = ? WHERE id = ?", subject, body, blastID)
+	return err
+}
+
+func (sq *Sqlite) UpdateBlastSchedule(blastID int, sendAt time.Time) error {
+	_, err := sq.Exec("UPDATE blasts SET send_at = ? WHERE id = ?", sendAt.UTC(), blastID)
+	return err
+}
+
+// SetBlastError records why a blast stopped sending, or clears it when empty.
+func (sq *Sqlite) SetBlastError(blastID int, message string) error {
+	_, err := sq.Exec("UPDATE blasts SET last_error = NULLIF(?, '') WHERE id = ?", message, blastID)
+	return err
+}
+
+// TransitionBlastStatus moves a blast to a new status only if it currently has
+// the expected one. It reports whether the transition happened, which lets
+// concurrent callers race for a blast without double sending it.
+func (sq *Sqlite) TransitionBlastStatus(blastID int, from BlastStatus, to BlastStatus) (bool, error) {
+	res, err := sq.Exec("UPDATE blasts SET status = ? WHERE id = ? AND status = ?", to, blastID, from)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
@@ -0,0 +1,71 @@
+package datastore
+
+import (
+	"fmt"
+)
+
+// maxChurnReasons is how many reasons for leaving QueryListChurn returns.
+const maxChurnReasons = 10
+
+// ReasonCount is how many subscribers left a list for one reason.
+type ReasonCount struct {
+	Reason string
+	Count  int
+}
+
+// ListChurn sums up who joined and left a list, over the last Days days and
+// since it was created.
+type ListChurn struct {
+	Days int
+	// Subscribed counts the current subscribers
+	Subscribed int
+	// Joined and Left count subscriptions started and ended in the last Days days
+	Joined int
+	Left   int
+	// Unsubscribed counts everyone who ever left
+	Unsubscribed int
+	// Reasons holds the most common reasons people gave for leaving, most
+	// common first. Those who gave none are counted under the empty reason.
+	Reasons []ReasonCount
+}
+
+// Rate is the share of subscribers who left in the last Days days, out of
+// everyone subscribed at some point in them, as a percentage.
+func (c ListChurn) Rate() string {
+	if c.Subscribed+c.Left == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(c.Left)/float64(c.Subscribed+c.Left))
+}
+
+// QueryListChurn counts the list's subscriptions, looking back the given
+// number of days for recent ones.
+func (sq *Sqlite) QueryListChurn(listID int, days int) (ListChurn, error) {
+	churn := ListChurn{Days: days}
+	since := fmt.Sprintf("-%d days", days)
+	err := sq.QueryRow(`SELECT
+        COUNT(*) FILTER (WHERE unsubscribed_at IS NULL),
+        COUNT(*) FILTER (WHERE time_joined >= datetime('now', ?)),
+        COUNT(*) FILTER (WHERE unsubscribed_at >= datetime('now', ?)),
+        COUNT(unsubscribed_at)
+        FROM subscriptions WHERE list_id = ?`, since, since, listID).Scan(&churn.Subscribed, &churn.Joined, &churn.Left, &churn.Unsubscribed)
+	if err != nil {
+		return churn, err
+	}
+
+	rows, err := sq.Query(`SELECT COALESCE(unsub_reason, ''), COUNT(*) FROM subscriptions
+        WHERE list_id = ? AND unsubscribed_at IS NOT NULL
+        GROUP BY 1 ORDER BY 2 DESC, 1 LIMIT ?`, listID, maxChurnReasons)
+	if err != nil {
+		return churn, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var reason ReasonCount
+		if err = rows.Scan(&reason.Reason, &reason.Count); err != nil {
+			return churn, err
+		}
+		churn.Reasons = append(churn.Reasons, reason)
+	}
+	return churn, rows.Err()
+}
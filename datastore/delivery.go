@@ -0,0 +1,224 @@
+package datastore
+
+import (
+	"database/sql"
+	"time"
+)
+
+type DeliveryStatus string
+
+const (
+	DeliveryPending DeliveryStatus = "pending"
+	DeliverySent    DeliveryStatus = "sent"
+	DeliveryFailed  DeliveryStatus = "failed"
+	// DeliveryGaveUp means every send attempt failed transiently and we stopped retrying
+	DeliveryGaveUp DeliveryStatus = "gave_up"
+	// DeliverySkipped means the recipient unsubscribed before we got to them
+	DeliverySkipped DeliveryStatus = "skipped"
+	// DeliveryClaimed means a worker is sending to the recipient right now
+	DeliveryClaimed DeliveryStatus = "claimed"
+	// DeliveryCancelled means the blast was cancelled before we got to them
+	DeliveryCancelled DeliveryStatus = "cancelled"
+)
+
+// Delivery is one recipient of a blast. UnsubToken is empty once the
+// recipient is no longer subscribed.
+type Delivery struct {
+	ID         int
+	BlastID    int
+	ListID     int
+	Email      string
+	UnsubToken string
+	Status     DeliveryStatus
+	Attempts   int
+	LastError  string
+
+	// ListName is the list the recipient is sent the blast as a subscriber of
+	ListName string
+
+	// What we know about the subscriber, for merge tags
+	FirstName  string
+	LastName   string
+	TimeJoined time.Time
+	Fields     Fields
+}
+
+type BlastProgress struct {
+	Total   int
+	Pending int
+	Sent    int
+	// Failed counts permanent failures, give ups, skipped recipients and
+	// those a cancelled blast never got to
+	Failed int
+}
+
+// Done is the number of recipients the blast has finished with, successfully or not.
+func (p BlastProgress) Done() int {
+	return p.Sent + p.Failed
+}
+
+// SnapshotBlastRecipients records who a blast goes to as pending deliveries,
+// so an interrupted blast can pick up where it left off. It only does so the
+// first time it is called for a blast, and returns the number of recipients.
+// Only subscribers matching the filter are included, and never suppressed
+// addresses or subscribers who paused their mail.
+//
+// Someone on several of the blast's lists, or on one list under differently
+// cased addresses, gets it once. Their delivery is for the first of the
+// blast's lists they are on, which decides the unsubscribe link they get.
+func (sq *Sqlite) SnapshotBlastRecipients(blastID int, filter SubscriberFilter) (int, error) {
+	where, args := filter.where()
+	_, err := sq.Exec(`
+      INSERT INTO deliveries (blast_id, list_id, email, status, attempts, last_error)
+      SELECT ?, list_id, email, ?, 0, ''
+      FROM (
+        SELECT subscriptions.list_id, subscriptions.email, subscriptions.time_joined, bl.position,
+          ROW_NUMBER() OVER (PARTITION BY `+normalizedEmail+` ORDER BY bl.position, subscriptions.time_joined) AS n
+        FROM subscriptions
+        JOIN blast_lists bl ON bl.list_id = subscriptions.list_id AND bl.blast_id = ?
+        WHERE NOT EXISTS (SELECT 1 FROM deliveries WHERE blast_id = ?)`+notSuppressed+notPaused+where+`
+      )
+      WHERE n = 1
+      ORDER BY position, time_joined
+  `, append([]any{blastID, DeliveryPending, blastID, blastID}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+	var total int
+	err = sq.QueryRow("SELECT COUNT(*) FROM deliveries WHERE blast_id = ?", blastID).Scan(&total)
+	return total, err
+}
+
+func (sq *Sqlite) QueryPendingDeliveries(blastID int) ([]Delivery, error) {
+	rows, err := sq.Query(`
+      SELECT d.id, d.blast_id, d.list_id, ml.name, d.email, COALESCE(s.unsub_token, ''), d.status, d.attempts, d.last_error,
+        COALESCE(s.first_name, ''), COALESCE(s.last_name, ''), s.time_joined, COALESCE(s.fields, '')
+      FROM deliveries d
+      JOIN mailing_list ml ON ml.id = d.list_id
+      LEFT JOIN subscriptions s ON s.list_id = d.list_id AND s.email = d.email AND s.unsubscribed_at IS NULL
+      WHERE d.blast_id = ? AND d.status = ?
+      ORDER BY d.id
+  `, blastID, DeliveryPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []Delivery
+	for rows.Next() {
+		var d Delivery
+		var timeJoined sql.NullTime
+		var fields string
+		if err = rows.Scan(&d.ID, &d.BlastID, &d.ListID, &d.ListName, &d.Email, &d.UnsubToken, &d.Status, &d.Attempts, &d.LastError,
+			&d.FirstName, &d.LastName, &timeJoined, &fields); err != nil {
+			return nil, err
+		}
+		d.TimeJoined = timeJoined.Time
+		if d.Fields, err = decodeFields(fields); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+func (sq *Sqlite) UpdateDelivery(deliveryID int, status DeliveryStatus, attempts int, lastError string) error {
+	_, err := sq.Exec("UPDATE deliveries SET status = ?, attempts = ?, last_error = ?, time_updated = CURRENT_TIMESTAMP WHERE id = ?",
+		status, attempts, lastError, deliveryID)
+	return err
+}
+
+// ClaimDelivery marks a pending delivery as being sent, so it isn't picked up
+// again while in flight. It reports false if the delivery is no longer pending.
+func (sq *Sqlite) ClaimDelivery(deliveryID int) (bool, error) {
+	result, err := sq.Exec("UPDATE deliveries SET status = ?, time_updated = CURRENT_TIMESTAMP WHERE id = ? AND status = ?",
+		DeliveryClaimed, deliveryID, DeliveryPending)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// unclaimedStatus is what a claimed delivery goes back to when it wasn't sent:
+// pending, unless its blast has since been cancelled.
+const unclaimedStatus = "CASE WHEN (SELECT status FROM blasts WHERE id = deliveries.blast_id) = ? THEN ? ELSE ? END"
+
+// ReleaseDelivery hands back a claimed delivery that was stopped before sending.
+func (sq *Sqlite) ReleaseDelivery(deliveryID int, attempts int, lastError string) error {
+	_, err := sq.Exec("UPDATE deliveries SET status = "+unclaimedStatus+", attempts = ?, last_error = ?, time_updated = CURRENT_TIMESTAMP WHERE id = ? AND status = ?",
+		BlastCancelled, DeliveryCancelled, DeliveryPending, attempts, lastError, deliveryID, DeliveryClaimed)
+	return err
+}
+
+// ReleaseClaimedDeliveries hands back every claimed delivery. Nothing is in
+// flight on startup, so any left were interrupted by a restart.
+func (sq *Sqlite) ReleaseClaimedDeliveries() error {
+	_, err := sq.Exec("UPDATE deliveries SET status = "+unclaimedStatus+", time_updated = CURRENT_TIMESTAMP WHERE status = ?",
+		BlastCancelled, DeliveryCancelled, DeliveryPending, DeliveryClaimed)
+	return err
+}
+
+// CancelPendingDeliveries marks the recipients a blast hasn't got to as cancelled.
+func (sq *Sqlite) CancelPendingDeliveries(blastID int) error {
+	_, err := sq.Exec("UPDATE deliveries SET status = ?, time_updated = CURRENT_TIMESTAMP WHERE blast_id = ? AND status = ?",
+		DeliveryCancelled, blastID, DeliveryPending)
+	return err
+}
+
+func (sq *Sqlite) QueryBlastProgress(blastID int) (BlastProgress, error) {
+	rows, err := sq.Query("SELECT status, COUNT(*) FROM deliveries WHERE blast_id = ? GROUP BY status", blastID)
+	if err != nil {
+		return BlastProgress{}, err
+	}
+	defer rows.Close()
+
+	var progress BlastProgress
+	for rows.Next() {
+		var status DeliveryStatus
+		var count int
+		if err = rows.Scan(&status, &count); err != nil {
+			return BlastProgress{}, err
+		}
+		progress.Total += count
+		switch status {
+		case DeliveryPending, DeliveryClaimed:
+			progress.Pending += count
+		case DeliverySent:
+			progress.Sent += count
+		default:
+			progress.Failed += count
+		}
+	}
+	return progress, rows.Err()
+}
+
+// CountPendingRecipients is how many recipients are still waiting across every
+// blast that will send. Blasts that haven't started count their whole lists,
+// since segments are only applied once a blast starts sending.
+func (sq *Sqlite) CountPendingRecipients() (int, error) {
+	var count int
+	err := sq.QueryRow(`
+      SELECT
+        (SELECT COUNT(*) FROM deliveries d JOIN blasts b ON b.id = d.blast_id
+          WHERE d.status IN (?, ?) AND b.status IN (?, ?, ?))
+        +
+        (SELECT COUNT(*) FROM (
+          SELECT DISTINCT bl.blast_id, `+normalizedEmail+`
+          FROM subscriptions
+          JOIN blast_lists bl ON bl.list_id = subscriptions.list_id
+          JOIN blasts b ON b.id = bl.blast_id
+          WHERE b.status IN (?, ?) AND NOT EXISTS (SELECT 1 FROM deliveries WHERE blast_id = b.id)
+            AND subscriptions.unsubscribed_at IS NULL`+notSuppressed+notPaused+`
+        ))
+  `, DeliveryPending, DeliveryClaimed, BlastScheduled, BlastPaused, BlastSending, BlastScheduled, BlastPaused).Scan(&count)
+	return count, err
+}
+
+// CountDeliveriesSince counts deliveries that reached the given status since a point in time.
+func (sq *Sqlite) CountDeliveriesSince(status DeliveryStatus, since time.Time) (int, error) {
+	var count int
+	err := sq.QueryRow("SELECT COUNT(*) FROM deliveries WHERE status = ? AND time_updated >= ?",
+		status, since.UTC().Format("2006-01-02 15:04:05")).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,74 @@
+package datastore
+
+import (
+	"time"
+)
+
+// Draft is an unsent message, saved as it is being written.
+type Draft struct {
+	ID          int
+	ListID      int
+	Subject     string
+	Body        string
+	Author      string
+	TimeCreated time.Time
+	TimeUpdated time.Time
+}
+
+const draftColumns = `
+    id, list_id, subject, body, author, time_created, time_updated
+    FROM drafts
+`
+
+func scanDraft(row scanner) (Draft, error) {
+	var d Draft
+	err := row.Scan(&d.ID, &d.ListID, &d.Subject, &d.Body, &d.Author, &d.TimeCreated, &d.TimeUpdated)
+	return d, err
+}
+
+func (sq *Sqlite) CreateDraft(listID int, subject string, body string, author string) (int, error) {
+	res, err := sq.Exec("INSERT INTO drafts (list_id, subject, body, author) VALUES (?, ?, ?, ?)", listID, subject, body, author)
+	if err != nil {
+		return 0, err
+	}
+
+	lastInsertID, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(lastInsertID), nil
+}
+
+// GetDraft returns sql.ErrNoRows when no draft has the given ID.
+func (sq *Sqlite) GetDraft(draftID int) (Draft, error) {
+	return scanDraft(sq.QueryRow("SELECT"+draftColumns+"WHERE id = ?", draftID))
+}
+
+func (sq *Sqlite) UpdateDraft(draftID int, subject string, body string) error {
+	_, err := sq.Exec("UPDATE drafts SET subject = ?, body = ?, time_updated = CURRENT_TIMESTAMP WHERE id = ?", subject, body, draftID)
+	return err
+}
+
+func (sq *Sqlite) DeleteDraft(draftID int) error {
+	_, err := sq.Exec("DELETE FROM drafts WHERE id = ?", draftID)
+	return err
+}
+
+// QueryListDrafts returns the list's drafts, most recently edited first.
+func (sq *Sqlite) QueryListDrafts(listID int) ([]Draft, error) {
+	rows, err := sq.Query("SELECT"+draftColumns+"WHERE list_id = ? ORDER BY time_updated DESC", listID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var drafts []Draft
+	for rows.Next() {
+		d, err := scanDraft(rows)
+		if err != nil {
+			return nil, err
+		}
+		drafts = append(drafts, d)
+	}
+	return drafts, rows.Err()
+}
@@ -0,0 +1,74 @@
+package datastore
+
+import (
+	"strings"
+	"time"
+)
+
+// SubscriberStatus is whether a subscriber can still be sent blasts.
+type SubscriberStatus string
+
+const (
+	SubscriberActive     SubscriberStatus = "subscribed"
+	SubscriberSuppressed SubscriberStatus = "suppressed"
+	SubscriberPaused     SubscriberStatus = "paused"
+	// SubscriberUnsubscribed left the list, and is kept for churn statistics
+	SubscriberUnsubscribed SubscriberStatus = "unsubscribed"
+)
+
+// ExportedSubscriber is a subscriber along with the list they are on.
+type ExportedSubscriber struct {
+	SubscriberInfo
+	ListName string
+	Status   SubscriberStatus
+}
+
+// ExportSubscribers calls fn with each subscriber of the lists in turn, reading
+// them as it goes rather than all at once. It stops at the first error fn returns.
+func (sq *Sqlite) ExportSubscribers(listIDs []int, fn func(ExportedSubscriber) error) error {
+	placeholders := make([]string, len(listIDs))
+	args := make([]any, len(listIDs))
+	for i, listID := range listIDs {
+		placeholders[i] = "?"
+		args[i] = listID
+	}
+	rows, err := sq.Query(`SELECT m.name, `+normalizedEmail+` IN (SELECT email FROM suppressions),`+subscriberColumns+`
+        JOIN mailing_list m ON m.id = subscriptions.list_id
+        WHERE list_id IN (`+strings.Join(placeholders, ", ")+`) ORDER BY m.name, time_joined`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var sub ExportedSubscriber
+		var suppressed bool
+		sub.SubscriberInfo, err = scanSubscriber(prefixScanner{rows, []any{&sub.ListName, &suppressed}})
+		if err != nil {
+			return err
+		}
+		sub.Status = SubscriberActive
+		if sub.IsUnsubscribed() {
+			sub.Status = SubscriberUnsubscribed
+		} else if suppressed {
+			sub.Status = SubscriberSuppressed
+		} else if sub.PausedUntil.After(time.Now()) {
+			sub.Status = SubscriberPaused
+		}
+		if err = fn(sub); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// prefixScanner scans the leading columns of a row into dest, and hands the
+// rest to whoever scans it.
+type prefixScanner struct {
+	row  scanner
+	dest []any
+}
+
+func (p prefixScanner) Scan(dest ...any) error {
+	return p.row.Scan(append(p.dest, dest...)...)
+}
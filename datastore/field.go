@@ -0,0 +1,261 @@
+package datastore
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type FieldType string
+
+const (
+	FieldString FieldType = "string"
+	FieldNumber FieldType = "number"
+	// FieldDate values are stored as YYYY-MM-DD, so they sort as text
+	FieldDate FieldType = "date"
+	FieldBool FieldType = "bool"
+)
+
+// FieldTypes lists every field type, in the order the admin panel offers them.
+var FieldTypes = []FieldType{FieldString, FieldNumber, FieldDate, FieldBool}
+
+const FieldDateLayout = "2006-01-02"
+
+// ListField is a custom attribute subscribers of a list can have.
+type ListField struct {
+	ID       int
+	ListID   int
+	Name     string
+	Type     FieldType
+	Required bool
+}
+
+// fieldNamePattern keeps names usable as merge tags, such as {{.Fields.plan}}.
+var fieldNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,39}$`)
+
+// HoneypotField is a signup form field people can't see, left empty by
+// everyone but bots filling in every field they find. Its name is unlikely to
+// be a real field's, so no list's own fields are mistaken for it.
+const HoneypotField = "hp_confirm_address"
+
+// FormTokenField holds the token from /subscribe/token, when the signup form
+// has to wait before it can be submitted.
+const FormTokenField = "form_token"
+
+// reservedFieldNames are form values /subscribe already uses for itself,
+// including its honeypot and form token, and the subscribers API's tag filter.
+var reservedFieldNames = map[string]bool{"list": true, "email": true, "first_name": true, "last_name": true, "tag": true, HoneypotField: true, FormTokenField: true}
+
+func ValidateField(name string, fieldType FieldType) error {
+	if !fieldNamePattern.MatchString(name) {
+		return errors.New(fmt.Sprintf("Invalid field name %s: use lower case letters, digits and underscores, starting with a letter", name))
+	}
+	if reservedFieldNames[name] {
+		return errors.New(fmt.Sprintf("Field name %s is reserved", name))
+	}
+	for _, t := range FieldTypes {
+		if t == fieldType {
+			return nil
+		}
+	}
+	return errors.New(fmt.Sprintf("Invalid field type: %s", fieldType))
+}
+
+// Parse reads a value for the field as submitted in a form. It returns nil for
+// an empty value, which is an error only if the field is required.
+func (f ListField) Parse(raw string) (any, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		if f.Required && f.Type != FieldBool {
+			return nil, errors.New(fmt.Sprintf("Field %s is required", f.Name))
+		}
+		if f.Type == FieldBool {
+			return false, nil
+		}
+		return nil, nil
+	}
+	switch f.Type {
+	case FieldNumber:
+		n, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Field %s must be a number", f.Name))
+		}
+		return n, nil
+	case FieldDate:
+		d, err := time.Parse(FieldDateLayout, raw)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Field %s must be a date like 2006-01-02", f.Name))
+		}
+		return d.Format(FieldDateLayout), nil
+	case FieldBool:
+		switch strings.ToLower(raw) {
+		case "on", "true", "yes", "1":
+			return true, nil
+		case "off", "false", "no", "0":
+			return false, nil
+		}
+		return nil, errors.New(fmt.Sprintf("Field %s must be true or false", f.Name))
+	}
+	return raw, nil
+}
+
+// FormatFieldValue shows a stored field value as text.
+func FormatFieldValue(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return fmt.Sprint(value)
+}
+
+// Fields are a subscriber's custom field values, keyed by field name.
+type Fields map[string]any
+
+func (f Fields) Format(name string) string {
+	return FormatFieldValue(f[name])
+}
+
+func encodeFields(fields Fields) (string, error) {
+	if len(fields) == 0 {
+		return "{}", nil
+	}
+	encoded, err := json.Marshal(fields)
+	return string(encoded), err
+}
+
+func decodeFields(encoded string) (Fields, error) {
+	fields := make(Fields)
+	if encoded == "" {
+		return fields, nil
+	}
+	err := json.Unmarshal([]byte(encoded), &fields)
+	return fields, err
+}
+
+func (sq *Sqlite) CreateListField(listID int, name string, fieldType FieldType, required bool) error {
+	_, err := sq.Exec("INSERT INTO list_fields (list_id, name, type, required) VALUES (?, ?, ?, ?)", listID, name, fieldType, required)
+	return err
+}
+
+// DeleteListField removes a field along with every subscriber's value for it.
+func (sq *Sqlite) DeleteListField(listID int, name string) error {
+	tx, err := sq.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("DELETE FROM list_fields WHERE list_id = ? AND name = ?", listID, name); err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE subscriptions SET fields = json_remove(fields, ?) WHERE list_id = ? AND fields IS NOT NULL", "$."+name, listID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (sq *Sqlite) QueryListFields(listID int) ([]ListField, error) {
+	rows, err := sq.Query("SELECT id, list_id, name, type, required FROM list_fields WHERE list_id = ? ORDER BY id", listID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var fields []ListField
+	for rows.Next() {
+		var f ListField
+		if err = rows.Scan(&f.ID, &f.ListID, &f.Name, &f.Type, &f.Required); err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+	return fields, rows.Err()
+}
+
+func (sq *Sqlite) UpdateSubscriberFields(listID int, email string, fields Fields) error {
+	encoded, err := encodeFields(fields)
+	if err != nil {
+		return err
+	}
+	res, err := sq.Exec("UPDATE subscriptions SET fields = ? WHERE list_id = ? AND email = ?", encoded, listID, email)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+type FieldOp string
+
+const (
+	FieldEq  FieldOp = "eq"
+	FieldNe  FieldOp = "ne"
+	FieldGt  FieldOp = "gt"
+	FieldGte FieldOp = "gte"
+	FieldLt  FieldOp = "lt"
+	FieldLte FieldOp = "lte"
+)
+
+var fieldOpSQL = map[FieldOp]string{
+	FieldEq:  "IS",
+	FieldNe:  "IS NOT",
+	FieldGt:  ">",
+	FieldGte: ">=",
+	FieldLt:  "<",
+	FieldLte: "<=",
+}
+
+// FieldCondition matches subscribers by one of their custom field values.
+type FieldCondition struct {
+	Field ListField
+	Op    FieldOp
+	Value any
+}
+
+// NewFieldCondition checks a condition on a field and parses its value. Only
+// numbers and dates can be compared by order. An empty value matches
+// subscribers who don't have the field set.
+func NewFieldCondition(field ListField, op FieldOp, raw string) (FieldCondition, error) {
+	c := FieldCondition{Field: field, Op: op}
+	if _, ok := fieldOpSQL[op]; !ok {
+		return c, errors.New(fmt.Sprintf("Invalid condition on field %s: %s", field.Name, op))
+	}
+	if op != FieldEq && op != FieldNe && field.Type != FieldNumber && field.Type != FieldDate {
+		return c, errors.New(fmt.Sprintf("Field %s can only be compared with eq or ne", field.Name))
+	}
+	field.Required = false
+	value, err := field.Parse(raw)
+	if err != nil {
+		return c, err
+	}
+	if value == nil && op != FieldEq && op != FieldNe {
+		return c, errors.New(fmt.Sprintf("Field %s needs a value to compare with", field.Name))
+	}
+	c.Value = value
+	return c, nil
+}
+
+func (c FieldCondition) filter() (string, []any) {
+	column := "json_extract(fields, ?)"
+	if c.Field.Type == FieldBool {
+		// Subscribers from before a boolean field existed count as false
+		column = "COALESCE(json_extract(fields, ?), 0)"
+	}
+	return column + " " + fieldOpSQL[c.Op] + " ?", []any{"$." + c.Field.Name, c.Value}
+}
@@ -0,0 +1,103 @@
+package datastore
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// QueryListEmails returns the lower cased address of everyone on the list, or
+// who has left it, telling if they are still subscribed.
+func (sq *Sqlite) QueryListEmails(listID int) (map[string]bool, error) {
+	rows, err := sq.Query("SELECT "+normalizedEmail+", unsubscribed_at IS NULL FROM subscriptions WHERE list_id = ?", listID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	emails := make(map[string]bool)
+	for rows.Next() {
+		var email string
+		var active bool
+		if err = rows.Scan(&email, &active); err != nil {
+			return nil, err
+		}
+		emails[email] = active
+	}
+	return emails, rows.Err()
+}
+
+// ImportSubscribers adds a batch of subscribers in one transaction, along with
+// their tags. Addresses already on the list are left alone. It returns how
+// many were added.
+func (sq *Sqlite) ImportSubscribers(listID int, subs []SubscriberInfo) (int, error) {
+	tx, err := sq.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	imported := 0
+	for _, sub := range subs {
+		unsubToken, err := uuid.NewUUID()
+		if err != nil {
+			return 0, err
+		}
+		fields, err := encodeFields(sub.Fields)
+		if err != nil {
+			return 0, err
+		}
+		res, err := tx.Exec("INSERT OR IGNORE INTO subscriptions (list_id, email, unsub_token, first_name, last_name, fields) VALUES (?, ?, ?, ?, ?, ?)",
+			listID, sub.Email, unsubToken.String(), sub.FirstName, sub.LastName, fields)
+		if err != nil {
+			return 0, err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return 0, err
+		} else if n == 0 {
+			continue
+		}
+		imported++
+		for _, tag := range sub.Tags {
+			if _, err = tx.Exec("INSERT OR IGNORE INTO subscriber_tags (list_id, email, tag) VALUES (?, ?, ?)", listID, sub.Email, tag); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return imported, tx.Commit()
+}
+
+// Import is a record of a CSV import, kept so its report can be downloaded.
+type Import struct {
+	ID       int
+	ListID   int
+	Author   string
+	DryRun   bool
+	Total    int
+	Imported int
+	Rejected int
+	// Report is a CSV of the rejected rows and why
+	Report      string
+	TimeCreated time.Time
+}
+
+func (sq *Sqlite) CreateImport(i Import) (int, error) {
+	res, err := sq.Exec("INSERT INTO imports (list_id, author, dry_run, total, imported, rejected, report) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		i.ListID, i.Author, i.DryRun, i.Total, i.Imported, i.Rejected, i.Report)
+	if err != nil {
+		return 0, err
+	}
+	lastInsertID, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(lastInsertID), nil
+}
+
+// GetImport returns sql.ErrNoRows when no import has the given ID.
+func (sq *Sqlite) GetImport(importID int) (Import, error) {
+	var i Import
+	err := sq.QueryRow("SELECT id, list_id, COALESCE(author, ''), dry_run, total, imported, rejected, report, time_created FROM imports WHERE id = ?", importID).
+		Scan(&i.ID, &i.ListID, &i.Author, &i.DryRun, &i.Total, &i.Imported, &i.Rejected, &i.Report, &i.TimeCreated)
+	return i, err
+}
@@ -0,0 +1,169 @@
+package datastore
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/keur/chillmailer/util"
+)
+
+// notPaused leaves out subscribers who paused their mail.
+const notPaused = " AND (subscriptions.paused_until IS NULL OR subscriptions.paused_until <= datetime('now'))"
+
+// LoadSecret returns a random secret kept under the name, generating it the
+// first time it is asked for.
+func (sq *Sqlite) LoadSecret(name string) (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	_, err := sq.Exec("INSERT OR IGNORE INTO settings (name, value) VALUES (?, ?)", name, hex.EncodeToString(secret))
+	if err != nil {
+		return "", err
+	}
+	var value string
+	err = sq.QueryRow("SELECT value FROM settings WHERE name = ?", name).Scan(&value)
+	return value, err
+}
+
+// Subscription is one of the lists an address is on, or has left.
+type Subscription struct {
+	SubscriberInfo
+	ListID          int
+	ListName        string
+	ListDescription string
+}
+
+// QueryEmailSubscriptions returns every list the address is on or has left,
+// whatever its case.
+func (sq *Sqlite) QueryEmailSubscriptions(email string) ([]Subscription, error) {
+	rows, err := sq.Query(`SELECT m.id, m.name, COALESCE(m.description, ''),`+subscriberColumns+`
+        JOIN mailing_list m ON m.id = subscriptions.list_id
+        WHERE `+matchesEmail("subscriptions.email")+" ORDER BY m.name", util.NormalizeEmail(email))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subscriptions []Subscription
+	for rows.Next() {
+		var s Subscription
+		s.SubscriberInfo, err = scanSubscriber(prefixScanner{rows, []any{&s.ListID, &s.ListName, &s.ListDescription}})
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, s)
+	}
+	return subscriptions, rows.Err()
+}
+
+// Unsubscribe takes the address off the list, whatever its case, keeping the
+// reason given.
+func (sq *Sqlite) Unsubscribe(listID int, email string, reason string) error {
+	_, err := sq.Exec("UPDATE subscriptions SET unsubscribed_at = CURRENT_TIMESTAMP, unsub_reason = ? WHERE list_id = ? AND unsubscribed_at IS NULL AND "+matchesEmail("email"),
+		reason, listID, util.NormalizeEmail(email))
+	return err
+}
+
+// Resubscribe brings back a subscription the address left.
+func (sq *Sqlite) Resubscribe(listID int, email string) error {
+	_, err := sq.Exec(`UPDATE subscriptions SET time_joined = CURRENT_TIMESTAMP, unsubscribed_at = NULL, unsub_reason = NULL, unsub_blast_id = NULL
+        WHERE list_id = ? AND unsubscribed_at IS NOT NULL AND `+matchesEmail("email"), listID, util.NormalizeEmail(email))
+	return err
+}
+
+// PauseSubscriptions holds every blast to the address until the given time,
+// on all its lists. The zero time resumes them.
+func (sq *Sqlite) PauseSubscriptions(email string, until time.Time) error {
+	var pausedUntil any
+	if !until.IsZero() {
+		pausedUntil = until.UTC().Format("2006-01-02 15:04:05")
+	}
+	_, err := sq.Exec("UPDATE subscriptions SET paused_until = ? WHERE "+matchesEmail("email"), pausedUntil, util.NormalizeEmail(email))
+	return err
+}
+
+// EmailChangeExpiry is how long a new address has to be confirmed.
+const EmailChangeExpiry = 48 * time.Hour
+
+// CreateEmailChange starts moving an address's subscriptions to a new one,
+// returning the token that confirms it.
+func (sq *Sqlite) CreateEmailChange(oldEmail string, newEmail string) (string, error) {
+	token, err := uuid.NewRandom()
+	if err != nil {
+		return "", err
+	}
+	_, err = sq.Exec("INSERT INTO email_changes (token, old_email, new_email) VALUES (?, ?, ?)",
+		token.String(), util.NormalizeEmail(oldEmail), newEmail)
+	return token.String(), err
+}
+
+// ConfirmEmailChange moves every subscription, and its tags, to the new
+// address. Lists the new address is already on keep that subscription and drop
+// the old one, unless the new address had unsubscribed and the old one hadn't.
+// It returns the new address, or sql.ErrNoRows when the token is unknown or
+// expired.
+func (sq *Sqlite) ConfirmEmailChange(token string) (string, error) {
+	tx, err := sq.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var oldEmail, newEmail string
+	var timeCreated time.Time
+	err = tx.QueryRow("SELECT old_email, new_email, time_created FROM email_changes WHERE token = ?", token).Scan(&oldEmail, &newEmail, &timeCreated)
+	if err != nil {
+		return "", err
+	}
+	// Clear out this change along with any that expired
+	_, err = tx.Exec("DELETE FROM email_changes WHERE token = ? OR time_created < datetime('now', ?)",
+		token, fmt.Sprintf("-%d seconds", int(EmailChangeExpiry.Seconds())))
+	if err != nil {
+		return "", err
+	}
+	if time.Since(timeCreated) > EmailChangeExpiry {
+		if err = tx.Commit(); err != nil {
+			return "", err
+		}
+		return "", sql.ErrNoRows
+	}
+
+	newNormalized := util.NormalizeEmail(newEmail)
+	// Lists the new address left but the old one is still on, so the old
+	// subscription carries over rather than being dropped for the stale one
+	_, err = tx.Exec(`DELETE FROM subscriber_tags WHERE `+matchesEmail("email")+` AND list_id IN
+          (SELECT list_id FROM subscriptions WHERE `+matchesEmail("email")+` AND unsubscribed_at IS NOT NULL)
+          AND list_id IN (SELECT list_id FROM subscriptions WHERE `+matchesEmail("email")+` AND unsubscribed_at IS NULL)`,
+		newNormalized, newNormalized, oldEmail)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(`DELETE FROM subscriptions WHERE `+matchesEmail("email")+` AND unsubscribed_at IS NOT NULL AND list_id IN
+          (SELECT list_id FROM subscriptions WHERE `+matchesEmail("email")+` AND unsubscribed_at IS NULL)`,
+		newNormalized, oldEmail)
+	if err != nil {
+		return "", err
+	}
+	for _, stmt := range []string{
+		// Lists the new address is already on
+		`DELETE FROM subscriber_tags WHERE ` + matchesEmail("email") + ` AND list_id IN
+            (SELECT list_id FROM subscriptions WHERE ` + matchesEmail("email") + `)`,
+		`DELETE FROM subscriptions WHERE ` + matchesEmail("email") + ` AND list_id IN
+            (SELECT list_id FROM subscriptions WHERE ` + matchesEmail("email") + `)`,
+	} {
+		if _, err = tx.Exec(stmt, oldEmail, newNormalized); err != nil {
+			return "", err
+		}
+	}
+	for _, table := range []string{"subscriber_tags", "subscriptions"} {
+		if _, err = tx.Exec("UPDATE "+table+" SET email = ? WHERE "+matchesEmail("email"), newEmail, oldEmail); err != nil {
+			return "", err
+		}
+	}
+	return newEmail, tx.Commit()
+}
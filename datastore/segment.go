@@ -0,0 +1,336 @@
+package datastore
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// tagPattern keeps tags short and free of the commas that separate them.
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,39}$`)
+
+// ParseTags reads comma separated tags, lower casing them and dropping repeats.
+func ParseTags(raw string) ([]string, error) {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, tag := range strings.Split(raw, ",") {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if !tagPattern.MatchString(tag) {
+			return nil, errors.New(fmt.Sprintf("Invalid tag %s: use letters, digits, dashes and underscores", tag))
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// SetSubscriberTags replaces a subscriber's tags.
+func (sq *Sqlite) SetSubscriberTags(listID int, email string, tags []string) error {
+	tx, err := sq.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	err = tx.QueryRow("SELECT COUNT(*) FROM subscriptions WHERE list_id = ? AND email = ?", listID, email).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err = tx.Exec("DELETE FROM subscriber_tags WHERE list_id = ? AND email = ?", listID, email); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if _, err = tx.Exec("INSERT INTO subscriber_tags (list_id, email, tag) VALUES (?, ?, ?)", listID, email, tag); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// QueryListTags returns every tag in use on the list.
+func (sq *Sqlite) QueryListTags(listID int) ([]string, error) {
+	rows, err := sq.Query("SELECT DISTINCT tag FROM subscriber_tags WHERE list_id = ? ORDER BY tag", listID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err = rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// SubscriberFilter picks out some of a list's subscribers. The zero value
+// matches all of them.
+type SubscriberFilter struct {
+	// IncludeTags matches subscribers with any of the tags
+	IncludeTags []string
+	// ExcludeTags leaves out subscribers with any of the tags
+	ExcludeTags []string
+	// JoinedAfter and JoinedBefore are inclusive dates like 2006-01-02
+	JoinedAfter  string
+	JoinedBefore string
+	Conditions   []FieldCondition
+	// ActiveDays matches subscribers sent a blast from the list within that many days
+	ActiveDays int
+	// InactiveDays matches subscribers not sent one within that many days
+	InactiveDays int
+}
+
+func tagsFilter(tags []string) (string, []any) {
+	placeholders := make([]string, len(tags))
+	args := make([]any, len(tags))
+	for i, tag := range tags {
+		placeholders[i] = "?"
+		args[i] = tag
+	}
+	return `EXISTS (SELECT 1 FROM subscriber_tags t
+        WHERE t.list_id = subscriptions.list_id AND t.email = subscriptions.email AND t.tag IN (` + strings.Join(placeholders, ", ") + "))", args
+}
+
+const sentWithinFilter = `EXISTS (SELECT 1 FROM deliveries d
+    WHERE d.list_id = subscriptions.list_id AND d.email = subscriptions.email AND d.status = ? AND d.time_updated >= datetime('now', ?))`
+
+// where builds the conditions on the subscriptions table, each starting with
+// AND. Only current subscribers match.
+func (f SubscriberFilter) where() (string, []any) {
+	query := " AND subscriptions.unsubscribed_at IS NULL"
+	var args []any
+	if len(f.IncludeTags) > 0 {
+		filter, filterArgs := tagsFilter(f.IncludeTags)
+		query += " AND " + filter
+		args = append(args, filterArgs...)
+	}
+	if len(f.ExcludeTags) > 0 {
+		filter, filterArgs := tagsFilter(f.ExcludeTags)
+		query += " AND NOT " + filter
+		args = append(args, filterArgs...)
+	}
+	if f.JoinedAfter != "" {
+		query += " AND date(time_joined) >= ?"
+		args = append(args, f.JoinedAfter)
+	}
+	if f.JoinedBefore != "" {
+		query += " AND date(time_joined) <= ?"
+		args = append(args, f.JoinedBefore)
+	}
+	for _, c := range f.Conditions {
+		filter, filterArgs := c.filter()
+		query += " AND " + filter
+		args = append(args, filterArgs...)
+	}
+	if f.ActiveDays > 0 {
+		query += " AND " + sentWithinFilter
+		args = append(args, DeliverySent, fmt.Sprintf("-%d days", f.ActiveDays))
+	}
+	if f.InactiveDays > 0 {
+		query += " AND NOT " + sentWithinFilter
+		args = append(args, DeliverySent, fmt.Sprintf("-%d days", f.InactiveDays))
+	}
+	return query, args
+}
+
+// normalizedEmail is how we tell whether two subscriptions are for the same address.
+const normalizedEmail = "lower(trim(subscriptions.email))"
+
+// CountRecipients is how many addresses a blast to the lists would go to,
+// counting anyone on several of them once and leaving out suppressed and
+// paused ones.
+func (sq *Sqlite) CountRecipients(listIDs []int, filter SubscriberFilter) (int, error) {
+	placeholders := make([]string, len(listIDs))
+	args := make([]any, len(listIDs))
+	for i, listID := range listIDs {
+		placeholders[i] = "?"
+		args[i] = listID
+	}
+	where, filterArgs := filter.where()
+	var count int
+	err := sq.QueryRow("SELECT COUNT(DISTINCT "+normalizedEmail+") FROM subscriptions WHERE list_id IN ("+strings.Join(placeholders, ", ")+")"+notSuppressed+notPaused+where,
+		append(args, filterArgs...)...).Scan(&count)
+	return count, err
+}
+
+func (sq *Sqlite) CountListSubscribers(listID int, filter SubscriberFilter) (int, error) {
+	where, args := filter.where()
+	var count int
+	err := sq.QueryRow("SELECT COUNT(*) FROM subscriptions WHERE list_id = ?"+where, append([]any{listID}, args...)...).Scan(&count)
+	return count, err
+}
+
+// ParseFieldConditions reads conditions on custom fields written as a query
+// string. Each key is a field name, optionally followed by a dot and one of
+// eq, ne, gt, gte, lt or lte, such as plan=pro&age.gte=18.
+func ParseFieldConditions(query url.Values, fields []ListField) ([]FieldCondition, error) {
+	byName := make(map[string]ListField, len(fields))
+	for _, field := range fields {
+		byName[field.Name] = field
+	}
+
+	var conditions []FieldCondition
+	for key, values := range query {
+		name, op, found := strings.Cut(key, ".")
+		if !found {
+			op = string(FieldEq)
+		}
+		field, ok := byName[name]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("No such field: %s", name))
+		}
+		for _, value := range values {
+			condition, err := NewFieldCondition(field, FieldOp(op), value)
+			if err != nil {
+				return nil, err
+			}
+			conditions = append(conditions, condition)
+		}
+	}
+	return conditions, nil
+}
+
+// SegmentRules are what a saved segment matches, as stored.
+type SegmentRules struct {
+	IncludeTags  []string `json:"include_tags,omitempty"`
+	ExcludeTags  []string `json:"exclude_tags,omitempty"`
+	JoinedAfter  string   `json:"joined_after,omitempty"`
+	JoinedBefore string   `json:"joined_before,omitempty"`
+	// Fields holds conditions on custom fields in the form ParseFieldConditions reads
+	Fields       string `json:"fields,omitempty"`
+	ActiveDays   int    `json:"active_days,omitempty"`
+	InactiveDays int    `json:"inactive_days,omitempty"`
+}
+
+// Filter checks the rules against the list's current custom fields.
+func (r SegmentRules) Filter(fields []ListField) (SubscriberFilter, error) {
+	filter := SubscriberFilter{
+		IncludeTags:  r.IncludeTags,
+		ExcludeTags:  r.ExcludeTags,
+		JoinedAfter:  r.JoinedAfter,
+		JoinedBefore: r.JoinedBefore,
+		ActiveDays:   r.ActiveDays,
+		InactiveDays: r.InactiveDays,
+	}
+	for _, date := range []string{r.JoinedAfter, r.JoinedBefore} {
+		if _, err := time.Parse(FieldDateLayout, date); date != "" && err != nil {
+			return filter, errors.New(fmt.Sprintf("Invalid join date %s, use 2006-01-02", date))
+		}
+	}
+	if r.ActiveDays < 0 || r.InactiveDays < 0 {
+		return filter, errors.New("Days must not be negative")
+	}
+	query, err := url.ParseQuery(r.Fields)
+	if err != nil {
+		return filter, errors.New(fmt.Sprintf("Invalid field conditions: %s", err))
+	}
+	filter.Conditions, err = ParseFieldConditions(query, fields)
+	return filter, err
+}
+
+// UsesField reports whether the rules have a condition on the named custom field.
+func (r SegmentRules) UsesField(name string) bool {
+	query, err := url.ParseQuery(r.Fields)
+	if err != nil {
+		return false
+	}
+	for key := range query {
+		if fieldName, _, _ := strings.Cut(key, "."); fieldName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Segment is a saved set of rules picking out some of a list's subscribers.
+type Segment struct {
+	ID          int
+	ListID      int
+	Name        string
+	Rules       SegmentRules
+	TimeCreated time.Time
+}
+
+func scanSegment(row scanner) (Segment, error) {
+	var s Segment
+	var rules string
+	err := row.Scan(&s.ID, &s.ListID, &s.Name, &rules, &s.TimeCreated)
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal([]byte(rules), &s.Rules)
+	return s, err
+}
+
+const segmentColumns = "id, list_id, name, rules, time_created FROM segments"
+
+func (sq *Sqlite) CreateSegment(listID int, name string, rules SegmentRules) (int, error) {
+	encoded, err := json.Marshal(rules)
+	if err != nil {
+		return 0, err
+	}
+	res, err := sq.Exec("INSERT INTO segments (list_id, name, rules) VALUES (?, ?, ?)", listID, name, string(encoded))
+	if err != nil {
+		return 0, err
+	}
+	lastInsertID, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(lastInsertID), nil
+}
+
+// GetSegment returns sql.ErrNoRows when no segment has the given ID.
+func (sq *Sqlite) GetSegment(segmentID int) (Segment, error) {
+	return scanSegment(sq.QueryRow("SELECT "+segmentColumns+" WHERE id = ?", segmentID))
+}
+
+func (sq *Sqlite) QueryListSegments(listID int) ([]Segment, error) {
+	rows, err := sq.Query("SELECT "+segmentColumns+" WHERE list_id = ? ORDER BY name", listID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var segments []Segment
+	for rows.Next() {
+		s, err := scanSegment(rows)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, s)
+	}
+	return segments, rows.Err()
+}
+
+var ErrSegmentInUse = errors.New("Segment is used by a pending blast")
+
+// DeleteSegment refuses to delete a segment a blast still has to be sent to.
+func (sq *Sqlite) DeleteSegment(segmentID int) error {
+	var pending int
+	err := sq.QueryRow("SELECT COUNT(*) FROM blasts WHERE segment_id = ? AND status IN (?, ?, ?)",
+		segmentID, BlastScheduled, BlastPaused, BlastSending).Scan(&pending)
+	if err != nil {
+		return err
+	}
+	if pending > 0 {
+		return ErrSegmentInUse
+	}
+	_, err = sq.Exec("DELETE FROM segments WHERE id = ?", segmentID)
+	return err
+}
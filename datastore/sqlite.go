@@ -4,12 +4,26 @@ import (
 	"crypto/subtle"
 	"database/sql"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/keur/chillmailer/util"
+	"github.com/mattn/go-sqlite3"
 )
 
+// driverName is SQLite with our own functions added to every connection.
+const driverName = "sqlite3_chillmailer"
+
+func init() {
+	sql.Register(driverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("email_hash", EmailHash, true)
+		},
+	})
+}
+
 type MailingListInfo struct {
 	Name           string
 	Description    string
@@ -21,16 +35,100 @@ type SubscriberInfo struct {
 	Email      string
 	UnsubToken string
 	TimeJoined time.Time
+	FirstName  string
+	LastName   string
+	Fields     Fields
+	Tags       []string
+	// PausedUntil is when mail resumes for a subscriber who paused it
+	PausedUntil time.Time
+	// TimeUnsubscribed is zero for current subscribers
+	TimeUnsubscribed time.Time
+	UnsubReason      string
+}
+
+// IsUnsubscribed tells if the subscriber has left the list.
+func (s SubscriberInfo) IsUnsubscribed() bool {
+	return !s.TimeUnsubscribed.IsZero()
 }
 
 type Datastore interface {
 	InitializeDatabase() error
 	GetMailingListID(name string) (int, error)
 	CreateMailingList(name string, description string) (int, error)
-	SubscribeToMailingList(listID int, email string) error
-	UnsubscribeRequest(listID int, email string, unsubToken string) error
+	SubscribeToMailingList(listID int, email string, firstName string, lastName string, fields Fields) error
+	CheckUnsubscribeToken(listID int, email string, unsubToken string) (SubscriberInfo, error)
+	UnsubscribeRequest(listID int, email string, unsubToken string, reason string, blastID int) error
 	QueryAllMailingLists() ([]MailingListInfo, error)
 	QueryMailingListSubscriberInfo(listID int) ([]SubscriberInfo, error)
+	GetSubscriber(listID int, email string) (SubscriberInfo, error)
+	QueryListSubscribers(listID int, filter SubscriberFilter) ([]SubscriberInfo, error)
+	CountListSubscribers(listID int, filter SubscriberFilter) (int, error)
+	CountRecipients(listIDs []int, filter SubscriberFilter) (int, error)
+	SetSubscriberTags(listID int, email string, tags []string) error
+	QueryListTags(listID int) ([]string, error)
+	CreateSegment(listID int, name string, rules SegmentRules) (int, error)
+	GetSegment(segmentID int) (Segment, error)
+	QueryListSegments(listID int) ([]Segment, error)
+	DeleteSegment(segmentID int) error
+	UpdateSubscriberFields(listID int, email string, fields Fields) error
+	CreateListField(listID int, name string, fieldType FieldType, required bool) error
+	DeleteListField(listID int, name string) error
+	QueryListFields(listID int) ([]ListField, error)
+	SnapshotBlastRecipients(blastID int, filter SubscriberFilter) (int, error)
+	QueryPendingDeliveries(blastID int) ([]Delivery, error)
+	UpdateDelivery(deliveryID int, status DeliveryStatus, attempts int, lastError string) error
+	ClaimDelivery(deliveryID int) (bool, error)
+	ReleaseDelivery(deliveryID int, attempts int, lastError string) error
+	ReleaseClaimedDeliveries() error
+	CancelPendingDeliveries(blastID int) error
+	QueryBlastProgress(blastID int) (BlastProgress, error)
+	CountDeliveriesSince(status DeliveryStatus, since time.Time) (int, error)
+	CountPendingRecipients() (int, error)
+	CreateBlast(listIDs []int, segmentID int, subject string, body string, webRoot string, author string, sendAt time.Time) (int, error)
+	GetBlast(blastID int) (Blast, error)
+	GetBlastByPublicID(publicID string) (Blast, error)
+	QueryBlastLists(blastID int) ([]BlastList, error)
+	AddSuppression(email string, reason string) error
+	RemoveSuppression(email string) error
+	IsSuppressed(email string) (bool, error)
+	QuerySuppressions() ([]Suppression, error)
+	QuerySuppressedEmails() (SuppressedEmails, error)
+	QueryListEmails(listID int) (map[string]bool, error)
+	ImportSubscribers(listID int, subs []SubscriberInfo) (int, error)
+	ExportSubscribers(listIDs []int, fn func(ExportedSubscriber) error) error
+	CreateImport(i Import) (int, error)
+	QuerySubjectData(email string) (SubjectData, error)
+	LoadSecret(name string) (string, error)
+	QueryEmailSubscriptions(email string) ([]Subscription, error)
+	Unsubscribe(listID int, email string, reason string) error
+	Resubscribe(listID int, email string) error
+	QueryListChurn(listID int, days int) (ListChurn, error)
+	PauseSubscriptions(email string, until time.Time) error
+	CreateEmailChange(oldEmail string, newEmail string) (string, error)
+	ConfirmEmailChange(token string) (string, error)
+	EraseSubject(email string) error
+	GetImport(importID int) (Import, error)
+	QueryBlastsByStatus(statuses ...BlastStatus) ([]Blast, error)
+	QueryListBlastsByStatus(listID int, statuses ...BlastStatus) ([]Blast, error)
+	QueryOwnBlastsByStatus(listID int, statuses ...BlastStatus) ([]Blast, error)
+	QueryListSentBlasts(listID int) ([]Blast, error)
+	ArchiveBlast(blastID int, html string, recipients int, timeSent time.Time) error
+	CreateDraft(listID int, subject string, body string, author string) (int, error)
+	GetDraft(draftID int) (Draft, error)
+	UpdateDraft(draftID int, subject string, body string) error
+	DeleteDraft(draftID int) error
+	QueryListDrafts(listID int) ([]Draft, error)
+	UpdateBlastContent(blastID int, subject string, body string) error
+	UpdateBlastSchedule(blastID int, sendAt time.Time) error
+	TransitionBlastStatus(blastID int, from BlastStatus, to BlastStatus) (bool, error)
+	SetBlastError(blastID int, message string) error
+	GetListGracePeriod(listID int) (time.Duration, bool, error)
+	SetListGracePeriod(listID int, gracePeriod time.Duration) error
+	ClearListGracePeriod(listID int) error
+	IsListArchivePublic(listID int) (bool, error)
+	SetListArchivePublic(listID int, public bool) error
+	GetListLayout(listID int) (string, string, error)
+	SetListLayout(listID int, htmlLayout string, textLayout string) error
 	RawHandle() *sql.DB
 	Close() error
 }
@@ -40,7 +138,7 @@ type Sqlite struct {
 }
 
 func NewSqlite(databaseFile string) (*Sqlite, error) {
-	db, err := sql.Open("sqlite3", databaseFile)
+	db, err := sql.Open(driverName, databaseFile)
 	if err != nil {
 		return nil, err
 	}
@@ -82,6 +180,266 @@ func (sq *Sqlite) InitializeDatabase() error {
         FOREIGN KEY(list_id) REFERENCES mailing_list(id),
         UNIQUE(list_id, email)
     );
+    `
+	_, err = sq.Exec(sqlStmt)
+	if err != nil {
+		return err
+	}
+
+	// Create deliveries table
+	sqlStmt = `
+    CREATE TABLE IF NOT EXISTS deliveries (
+        id             INTEGER PRIMARY KEY AUTOINCREMENT,
+        list_id        INTEGER,
+        email          TEXT,
+        status         TEXT,
+        attempts       INTEGER,
+        last_error     TEXT,
+        time_updated   DATETIME DEFAULT CURRENT_TIMESTAMP,
+        FOREIGN KEY(list_id) REFERENCES mailing_list(id)
+    );
+    `
+	_, err = sq.Exec(sqlStmt)
+	if err != nil {
+		return err
+	}
+
+	// Columns added after the first release
+	if err = sq.addColumnIfMissing("mailing_list", "grace_period_seconds", "INTEGER"); err != nil {
+		return err
+	}
+	if err = sq.addColumnIfMissing("deliveries", "blast_id", "INTEGER REFERENCES blasts(id)"); err != nil {
+		return err
+	}
+	if err = sq.addColumnIfMissing("mailing_list", "public_archive", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	if err = sq.addColumnIfMissing("subscriptions", "first_name", "TEXT"); err != nil {
+		return err
+	}
+	if err = sq.addColumnIfMissing("subscriptions", "last_name", "TEXT"); err != nil {
+		return err
+	}
+	// Custom field values, as a JSON object keyed by field name
+	if err = sq.addColumnIfMissing("subscriptions", "fields", "TEXT"); err != nil {
+		return err
+	}
+	// Subscribers can pause all their mail from the preference center
+	if err = sq.addColumnIfMissing("subscriptions", "paused_until", "DATETIME"); err != nil {
+		return err
+	}
+	// Unsubscribing keeps the subscription, along with when, why and which blast prompted it
+	if err = sq.addColumnIfMissing("subscriptions", "unsubscribed_at", "DATETIME"); err != nil {
+		return err
+	}
+	if err = sq.addColumnIfMissing("subscriptions", "unsub_reason", "TEXT"); err != nil {
+		return err
+	}
+	if err = sq.addColumnIfMissing("subscriptions", "unsub_blast_id", "INTEGER REFERENCES blasts(id)"); err != nil {
+		return err
+	}
+	if err = sq.addColumnIfMissing("mailing_list", "html_layout", "TEXT"); err != nil {
+		return err
+	}
+	if err = sq.addColumnIfMissing("mailing_list", "text_layout", "TEXT"); err != nil {
+		return err
+	}
+
+	// Create blasts table
+	sqlStmt = `
+    CREATE TABLE IF NOT EXISTS blasts (
+        id             INTEGER PRIMARY KEY AUTOINCREMENT,
+        list_id        INTEGER,
+        subject        TEXT,
+        body           TEXT,
+        web_root       TEXT,
+        status         TEXT,
+        send_at        DATETIME,
+        time_created   DATETIME DEFAULT CURRENT_TIMESTAMP,
+        FOREIGN KEY(list_id) REFERENCES mailing_list(id)
+    );
+    `
+	_, err = sq.Exec(sqlStmt)
+	if err != nil {
+		return err
+	}
+	if err = sq.addColumnIfMissing("blasts", "author", "TEXT"); err != nil {
+		return err
+	}
+	if err = sq.addColumnIfMissing("blasts", "html", "TEXT"); err != nil {
+		return err
+	}
+	if err = sq.addColumnIfMissing("blasts", "recipient_count", "INTEGER"); err != nil {
+		return err
+	}
+	if err = sq.addColumnIfMissing("blasts", "time_sent", "DATETIME"); err != nil {
+		return err
+	}
+	// Blasts to the whole list have no segment
+	if err = sq.addColumnIfMissing("blasts", "segment_id", "INTEGER"); err != nil {
+		return err
+	}
+	if err = sq.addColumnIfMissing("blasts", "public_id", "TEXT"); err != nil {
+		return err
+	}
+	// Why the blast last stopped sending on its own, until it is resumed
+	if err = sq.addColumnIfMissing("blasts", "last_error", "TEXT"); err != nil {
+		return err
+	}
+	// Blasts from before web versions existed get a random ID of their own
+	_, err = sq.Exec("UPDATE blasts SET public_id = lower(hex(randomblob(16))) WHERE public_id IS NULL")
+	if err != nil {
+		return err
+	}
+	_, err = sq.Exec("CREATE UNIQUE INDEX IF NOT EXISTS blasts_public_id ON blasts(public_id)")
+	if err != nil {
+		return err
+	}
+
+	// Create blast_lists table, with every list a blast goes to in order
+	sqlStmt = `
+    CREATE TABLE IF NOT EXISTS blast_lists (
+        blast_id       INTEGER,
+        list_id        INTEGER,
+        position       INTEGER,
+        FOREIGN KEY(blast_id) REFERENCES blasts(id),
+        FOREIGN KEY(list_id) REFERENCES mailing_list(id),
+        UNIQUE(blast_id, list_id)
+    );
+    `
+	_, err = sq.Exec(sqlStmt)
+	if err != nil {
+		return err
+	}
+	// Blasts from before several lists could be picked go to their own list only
+	_, err = sq.Exec(`
+    INSERT INTO blast_lists (blast_id, list_id, position)
+    SELECT id, list_id, 0 FROM blasts WHERE id NOT IN (SELECT blast_id FROM blast_lists)
+  `)
+	if err != nil {
+		return err
+	}
+
+	// Create suppressions table
+	sqlStmt = `
+    CREATE TABLE IF NOT EXISTS suppressions (
+        email          TEXT PRIMARY KEY,
+        reason         TEXT,
+        time_created   DATETIME DEFAULT CURRENT_TIMESTAMP
+    );
+    `
+	_, err = sq.Exec(sqlStmt)
+	if err != nil {
+		return err
+	}
+
+	// Create imports table
+	sqlStmt = `
+    CREATE TABLE IF NOT EXISTS imports (
+        id             INTEGER PRIMARY KEY AUTOINCREMENT,
+        list_id        INTEGER,
+        author         TEXT,
+        dry_run        INTEGER,
+        total          INTEGER,
+        imported       INTEGER,
+        rejected       INTEGER,
+        report         TEXT,
+        time_created   DATETIME DEFAULT CURRENT_TIMESTAMP,
+        FOREIGN KEY(list_id) REFERENCES mailing_list(id)
+    );
+    `
+	_, err = sq.Exec(sqlStmt)
+	if err != nil {
+		return err
+	}
+
+	// Create drafts table
+	sqlStmt = `
+    CREATE TABLE IF NOT EXISTS drafts (
+        id             INTEGER PRIMARY KEY AUTOINCREMENT,
+        list_id        INTEGER,
+        subject        TEXT,
+        body           TEXT,
+        author         TEXT,
+        time_created   DATETIME DEFAULT CURRENT_TIMESTAMP,
+        time_updated   DATETIME DEFAULT CURRENT_TIMESTAMP,
+        FOREIGN KEY(list_id) REFERENCES mailing_list(id)
+    );
+    `
+	_, err = sq.Exec(sqlStmt)
+	if err != nil {
+		return err
+	}
+
+	// Create list_fields table
+	sqlStmt = `
+    CREATE TABLE IF NOT EXISTS list_fields (
+        id             INTEGER PRIMARY KEY AUTOINCREMENT,
+        list_id        INTEGER,
+        name           TEXT,
+        type           TEXT,
+        required       INTEGER DEFAULT 0,
+        FOREIGN KEY(list_id) REFERENCES mailing_list(id),
+        UNIQUE(list_id, name)
+    );
+    `
+	_, err = sq.Exec(sqlStmt)
+	if err != nil {
+		return err
+	}
+
+	// Create subscriber_tags table
+	sqlStmt = `
+    CREATE TABLE IF NOT EXISTS subscriber_tags (
+        list_id        INTEGER,
+        email          TEXT,
+        tag            TEXT,
+        FOREIGN KEY(list_id) REFERENCES mailing_list(id),
+        UNIQUE(list_id, email, tag)
+    );
+    `
+	_, err = sq.Exec(sqlStmt)
+	if err != nil {
+		return err
+	}
+
+	// Create segments table
+	sqlStmt = `
+    CREATE TABLE IF NOT EXISTS segments (
+        id             INTEGER PRIMARY KEY AUTOINCREMENT,
+        list_id        INTEGER,
+        name           TEXT,
+        rules          TEXT,
+        time_created   DATETIME DEFAULT CURRENT_TIMESTAMP,
+        FOREIGN KEY(list_id) REFERENCES mailing_list(id),
+        UNIQUE(list_id, name)
+    );
+    `
+	_, err = sq.Exec(sqlStmt)
+	if err != nil {
+		return err
+	}
+
+	// Create settings table, for values the app generates for itself
+	sqlStmt = `
+    CREATE TABLE IF NOT EXISTS settings (
+        name           TEXT PRIMARY KEY,
+        value          TEXT
+    );
+    `
+	_, err = sq.Exec(sqlStmt)
+	if err != nil {
+		return err
+	}
+
+	// Create email_changes table, for new addresses waiting to be confirmed
+	sqlStmt = `
+    CREATE TABLE IF NOT EXISTS email_changes (
+        token          VARCHAR(36) PRIMARY KEY,
+        old_email      TEXT,
+        new_email      TEXT,
+        time_created   DATETIME DEFAULT CURRENT_TIMESTAMP
+    );
     `
 	_, err = sq.Exec(sqlStmt)
 	if err != nil {
@@ -90,6 +448,29 @@ func (sq *Sqlite) InitializeDatabase() error {
 	return nil
 }
 
+// addColumnIfMissing lets database files created by older versions pick up new columns.
+func (sq *Sqlite) addColumnIfMissing(table string, column string, definition string) error {
+	rows, err := sq.Query(fmt.Sprintf("SELECT name FROM pragma_table_info('%s')", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	_, err = sq.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
 const MailingListNoExist = 0
 
 func (sq *Sqlite) GetMailingListID(name string) (int, error) {
@@ -127,12 +508,29 @@ func (sq *Sqlite) CreateMailingList(name string, description string) (int, error
 	return int(lastInsertID), nil
 }
 
-func (sq *Sqlite) SubscribeToMailingList(listID int, email string) error {
+// SubscribeToMailingList brings back a subscription that was unsubscribed,
+// with the details given now. It fails with a unique constraint error when the
+// address is already subscribed.
+func (sq *Sqlite) SubscribeToMailingList(listID int, email string, firstName string, lastName string, fields Fields) error {
 	unsubToken, err := uuid.NewUUID()
 	if err != nil {
 		return err
 	}
-	_, err = sq.Exec("INSERT INTO subscriptions (list_id, email, unsub_token) VALUES (?, ?, ?)", listID, email, unsubToken.String())
+	encodedFields, err := encodeFields(fields)
+	if err != nil {
+		return err
+	}
+	res, err := sq.Exec(`UPDATE subscriptions SET first_name = ?, last_name = ?, fields = ?, time_joined = CURRENT_TIMESTAMP,
+        unsubscribed_at = NULL, unsub_reason = NULL, unsub_blast_id = NULL
+        WHERE list_id = ? AND `+matchesEmail("email")+` AND unsubscribed_at IS NOT NULL`, firstName, lastName, encodedFields, listID, util.NormalizeEmail(email))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	_, err = sq.Exec("INSERT INTO subscriptions (list_id, email, unsub_token, first_name, last_name, fields) VALUES (?, ?, ?, ?, ?, ?)",
+		listID, email, unsubToken.String(), firstName, lastName, encodedFields)
 	if err != nil {
 		return err
 	}
@@ -141,20 +539,31 @@ func (sq *Sqlite) SubscribeToMailingList(listID int, email string) error {
 
 var ErrorBadToken error = errors.New("Bad token provided")
 
-func (sq *Sqlite) UnsubscribeRequest(listID int, email string, unsubToken string) error {
-	var actualToken string
-	err := sq.QueryRow("SELECT unsub_token FROM subscriptions WHERE list_id = ? AND email = ?", listID, email).Scan(&actualToken)
+// CheckUnsubscribeToken returns the subscription the token is for. It
+// returns ErrorBadToken when the token is wrong, and sql.ErrNoRows when the
+// address was never on the list.
+func (sq *Sqlite) CheckUnsubscribeToken(listID int, email string, unsubToken string) (SubscriberInfo, error) {
+	sub, err := sq.GetSubscriber(listID, email)
 	if err != nil {
-		return err
+		return sub, err
 	}
-	if subtle.ConstantTimeCompare([]byte(unsubToken), []byte(actualToken)) != 1 {
-		return ErrorBadToken
+	if subtle.ConstantTimeCompare([]byte(unsubToken), []byte(sub.UnsubToken)) != 1 {
+		return sub, ErrorBadToken
 	}
-	_, err = sq.Exec("DELETE FROM subscriptions WHERE list_id = ? AND email = ?", listID, email)
-	if err != nil {
+	return sub, nil
+}
+
+// UnsubscribeRequest keeps the subscription, marking when it ended and why.
+// blastID is the blast whose link was followed, or zero. It is only kept if
+// the blast was sent to the subscriber.
+func (sq *Sqlite) UnsubscribeRequest(listID int, email string, unsubToken string, reason string, blastID int) error {
+	if _, err := sq.CheckUnsubscribeToken(listID, email, unsubToken); err != nil {
 		return err
 	}
-	return nil
+	_, err := sq.Exec(`UPDATE subscriptions SET unsubscribed_at = CURRENT_TIMESTAMP, unsub_reason = ?,
+        unsub_blast_id = (SELECT blast_id FROM deliveries WHERE blast_id = ? AND list_id = subscriptions.list_id AND email = subscriptions.email)
+        WHERE list_id = ? AND email = ? AND unsubscribed_at IS NULL`, reason, blastID, listID, email)
+	return err
 }
 
 func (sq *Sqlite) QueryAllMailingLists() ([]MailingListInfo, error) {
@@ -165,7 +574,7 @@ func (sq *Sqlite) QueryAllMailingLists() ([]MailingListInfo, error) {
           ml.time_created,
           COUNT(s.email) as num_subs
       FROM mailing_list ml
-      LEFT JOIN subscriptions s on ml.id = s.list_id
+      LEFT JOIN subscriptions s on ml.id = s.list_id AND s.unsubscribed_at IS NULL
       GROUP BY ml.id
       ORDER BY num_subs DESC;
   `)
@@ -182,8 +591,39 @@ func (sq *Sqlite) QueryAllMailingLists() ([]MailingListInfo, error) {
 	return infos, nil
 }
 
+const subscriberColumns = `
+    email, unsub_token, time_joined, COALESCE(first_name, ''), COALESCE(last_name, ''), COALESCE(fields, ''), paused_until,
+    unsubscribed_at, COALESCE(unsub_reason, ''),
+    COALESCE((SELECT group_concat(tag, ',') FROM subscriber_tags t
+        WHERE t.list_id = subscriptions.list_id AND t.email = subscriptions.email), '')
+    FROM subscriptions
+`
+
+func scanSubscriber(row scanner) (SubscriberInfo, error) {
+	var sub SubscriberInfo
+	var fields, tags string
+	var pausedUntil, unsubscribedAt sql.NullTime
+	err := row.Scan(&sub.Email, &sub.UnsubToken, &sub.TimeJoined, &sub.FirstName, &sub.LastName, &fields, &pausedUntil,
+		&unsubscribedAt, &sub.UnsubReason, &tags)
+	if err != nil {
+		return sub, err
+	}
+	sub.PausedUntil, sub.TimeUnsubscribed = pausedUntil.Time, unsubscribedAt.Time
+	if tags != "" {
+		sub.Tags = strings.Split(tags, ",")
+	}
+	sub.Fields, err = decodeFields(fields)
+	return sub, err
+}
+
 func (sq *Sqlite) QueryMailingListSubscriberInfo(listID int) ([]SubscriberInfo, error) {
-	rows, err := sq.Query("SELECT email, unsub_token, time_joined FROM subscriptions WHERE list_id = ?", listID)
+	return sq.QueryListSubscribers(listID, SubscriberFilter{})
+}
+
+// QueryListSubscribers returns the list's subscribers matching the filter.
+func (sq *Sqlite) QueryListSubscribers(listID int, filter SubscriberFilter) ([]SubscriberInfo, error) {
+	where, args := filter.where()
+	rows, err := sq.Query("SELECT"+subscriberColumns+"WHERE list_id = ?"+where+" ORDER BY time_joined", append([]any{listID}, args...)...)
 	if err != nil {
 		return nil, err
 	}
@@ -191,9 +631,61 @@ func (sq *Sqlite) QueryMailingListSubscriberInfo(listID int) ([]SubscriberInfo,
 
 	var subscribers []SubscriberInfo
 	for rows.Next() {
-		var sub SubscriberInfo
-		rows.Scan(&sub.Email, &sub.UnsubToken, &sub.TimeJoined)
+		sub, err := scanSubscriber(rows)
+		if err != nil {
+			return nil, err
+		}
 		subscribers = append(subscribers, sub)
 	}
-	return subscribers, nil
+	return subscribers, rows.Err()
+}
+
+// GetSubscriber returns sql.ErrNoRows when the email is not on the list.
+func (sq *Sqlite) GetSubscriber(listID int, email string) (SubscriberInfo, error) {
+	return scanSubscriber(sq.QueryRow("SELECT"+subscriberColumns+"WHERE list_id = ? AND email = ?", listID, email))
+}
+
+// GetListGracePeriod returns the list's own cancellation window, if it has one.
+func (sq *Sqlite) GetListGracePeriod(listID int) (time.Duration, bool, error) {
+	var seconds sql.NullInt64
+	err := sq.QueryRow("SELECT grace_period_seconds FROM mailing_list WHERE id = ?", listID).Scan(&seconds)
+	if err != nil {
+		return 0, false, err
+	}
+	return time.Duration(seconds.Int64) * time.Second, seconds.Valid, nil
+}
+
+func (sq *Sqlite) SetListGracePeriod(listID int, gracePeriod time.Duration) error {
+	_, err := sq.Exec("UPDATE mailing_list SET grace_period_seconds = ? WHERE id = ?", int64(gracePeriod/time.Second), listID)
+	return err
+}
+
+func (sq *Sqlite) ClearListGracePeriod(listID int) error {
+	_, err := sq.Exec("UPDATE mailing_list SET grace_period_seconds = NULL WHERE id = ?", listID)
+	return err
+}
+
+// IsListArchivePublic reports whether anyone may browse the list's sent blasts.
+func (sq *Sqlite) IsListArchivePublic(listID int) (bool, error) {
+	var public sql.NullBool
+	err := sq.QueryRow("SELECT public_archive FROM mailing_list WHERE id = ?", listID).Scan(&public)
+	return public.Bool, err
+}
+
+func (sq *Sqlite) SetListArchivePublic(listID int, public bool) error {
+	_, err := sq.Exec("UPDATE mailing_list SET public_archive = ? WHERE id = ?", public, listID)
+	return err
+}
+
+// GetListLayout returns the list's own HTML and text layouts. Either is empty
+// when the list uses the default.
+func (sq *Sqlite) GetListLayout(listID int) (string, string, error) {
+	var htmlLayout, textLayout sql.NullString
+	err := sq.QueryRow("SELECT html_layout, text_layout FROM mailing_list WHERE id = ?", listID).Scan(&htmlLayout, &textLayout)
+	return htmlLayout.String, textLayout.String, err
+}
+
+func (sq *Sqlite) SetListLayout(listID int, htmlLayout string, textLayout string) error {
+	_, err := sq.Exec("UPDATE mailing_list SET html_layout = NULLIF(?, ''), text_layout = NULLIF(?, '') WHERE id = ?", htmlLayout, textLayout, listID)
+	return err
 }
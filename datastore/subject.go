@@ -0,0 +1,272 @@
+package datastore
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/keur/chillmailer/util"
+)
+
+// SubjectDelivery is a blast that was, or is about to be, sent to an address.
+type SubjectDelivery struct {
+	BlastID     int            `json:"blast_id"`
+	ListName    string         `json:"list"`
+	Subject     string         `json:"subject"`
+	Status      DeliveryStatus `json:"status"`
+	Attempts    int            `json:"attempts"`
+	LastError   string         `json:"last_error"`
+	TimeUpdated time.Time      `json:"time_updated"`
+}
+
+// SubjectImportRow is a rejected import row holding an address, kept in the
+// import's report.
+type SubjectImportRow struct {
+	ImportID    int       `json:"import_id"`
+	ListName    string    `json:"list"`
+	Row         string    `json:"row"`
+	Reason      string    `json:"reason"`
+	TimeCreated time.Time `json:"time_created"`
+}
+
+// SubjectEmailChange is a change of address, from or to the address, that is
+// waiting to be confirmed. Its token is left out, since it confirms the change.
+type SubjectEmailChange struct {
+	OldEmail    string    `json:"old_email"`
+	NewEmail    string    `json:"new_email"`
+	TimeCreated time.Time `json:"time_created"`
+}
+
+// SubjectData is everything we hold about an email address, for answering
+// data subject requests.
+type SubjectData struct {
+	Email         string
+	Subscriptions []ExportedSubscriber
+	Deliveries    []SubjectDelivery
+	// Suppressions holds the address's suppression and its tombstone, if it has them
+	Suppressions []Suppression
+	ImportRows   []SubjectImportRow
+	EmailChanges []SubjectEmailChange
+}
+
+// matchesEmail compares a column against a normalized address.
+func matchesEmail(column string) string {
+	return "lower(trim(" + column + ")) = ?"
+}
+
+// QuerySubjectData finds the address on every list, whatever its case.
+func (sq *Sqlite) QuerySubjectData(email string) (SubjectData, error) {
+	email = util.NormalizeEmail(email)
+	data := SubjectData{Email: email}
+
+	var listIDs []int
+	rows, err := sq.Query("SELECT DISTINCT list_id FROM subscriptions WHERE "+matchesEmail("email"), email)
+	if err != nil {
+		return data, err
+	}
+	for rows.Next() {
+		var listID int
+		if err = rows.Scan(&listID); err != nil {
+			rows.Close()
+			return data, err
+		}
+		listIDs = append(listIDs, listID)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return data, err
+	}
+	err = sq.ExportSubscribers(listIDs, func(sub ExportedSubscriber) error {
+		if util.NormalizeEmail(sub.Email) == email {
+			data.Subscriptions = append(data.Subscriptions, sub)
+		}
+		return nil
+	})
+	if err != nil {
+		return data, err
+	}
+
+	rows, err = sq.Query(`SELECT d.blast_id, m.name, COALESCE(b.subject, ''), d.status, d.attempts, COALESCE(d.last_error, ''), d.time_updated
+        FROM deliveries d
+        JOIN mailing_list m ON m.id = d.list_id
+        LEFT JOIN blasts b ON b.id = d.blast_id
+        WHERE `+matchesEmail("d.email")+" ORDER BY d.time_updated", email)
+	if err != nil {
+		return data, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d SubjectDelivery
+		var blastID sql.NullInt64
+		if err = rows.Scan(&blastID, &d.ListName, &d.Subject, &d.Status, &d.Attempts, &d.LastError, &d.TimeUpdated); err != nil {
+			return data, err
+		}
+		d.BlastID = int(blastID.Int64)
+		data.Deliveries = append(data.Deliveries, d)
+	}
+	if err = rows.Err(); err != nil {
+		return data, err
+	}
+
+	rows, err = sq.Query("SELECT email, COALESCE(reason, ''), time_created FROM suppressions WHERE email IN (?, ?)", email, EmailHash(email))
+	if err != nil {
+		return data, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s Suppression
+		if err = rows.Scan(&s.Email, &s.Reason, &s.TimeCreated); err != nil {
+			return data, err
+		}
+		data.Suppressions = append(data.Suppressions, s)
+	}
+	if err = rows.Err(); err != nil {
+		return data, err
+	}
+
+	rows, err = sq.Query("SELECT COALESCE(old_email, ''), COALESCE(new_email, ''), time_created FROM email_changes WHERE "+
+		matchesEmail("old_email")+" OR "+matchesEmail("new_email")+" ORDER BY time_created", email, email)
+	if err != nil {
+		return data, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c SubjectEmailChange
+		if err = rows.Scan(&c.OldEmail, &c.NewEmail, &c.TimeCreated); err != nil {
+			return data, err
+		}
+		data.EmailChanges = append(data.EmailChanges, c)
+	}
+	if err = rows.Err(); err != nil {
+		return data, err
+	}
+
+	data.ImportRows, err = sq.queryImportRows(email)
+	return data, err
+}
+
+// queryImportRows finds the address in the reports of past imports.
+func (sq *Sqlite) queryImportRows(email string) ([]SubjectImportRow, error) {
+	rows, err := sq.Query(`SELECT i.id, m.name, i.report, i.time_created FROM imports i
+        JOIN mailing_list m ON m.id = i.list_id
+        WHERE instr(lower(i.report), ?) > 0 ORDER BY i.id`, email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var found []SubjectImportRow
+	for rows.Next() {
+		var importID int
+		var listName, report string
+		var timeCreated time.Time
+		if err = rows.Scan(&importID, &listName, &report, &timeCreated); err != nil {
+			return nil, err
+		}
+		matching, _, err := splitReport(report, email)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range matching {
+			found = append(found, SubjectImportRow{ImportID: importID, ListName: listName, Row: record[0], Reason: record[2], TimeCreated: timeCreated})
+		}
+	}
+	return found, rows.Err()
+}
+
+// splitReport separates the rows of an import report that hold the address
+// from the rest, which are written back out as CSV.
+func splitReport(report string, email string) ([][]string, string, error) {
+	in := csv.NewReader(strings.NewReader(report))
+	in.FieldsPerRecord = -1
+	var rest bytes.Buffer
+	out := csv.NewWriter(&rest)
+	var matching [][]string
+	for n := 0; ; n++ {
+		record, err := in.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, "", err
+		}
+		// Every row after the header leads with its number, address and reason
+		if n > 0 && len(record) >= 3 && util.NormalizeEmail(record[1]) == email {
+			matching = append(matching, record)
+			continue
+		}
+		if err = out.Write(record); err != nil {
+			return nil, "", err
+		}
+	}
+	out.Flush()
+	return matching, rest.String(), out.Error()
+}
+
+// EraseSubject forgets an address everywhere, in one transaction. Its
+// subscriptions, tags, suppression and pending changes of address to or from
+// it are deleted, and it is taken out of import reports. Deliveries are kept for blast statistics but their address
+// is replaced with its hash, and any still pending are skipped, so a blast
+// already sending doesn't get to them. The hash is added to the suppressions
+// so the address can't be mailed again by accident.
+func (sq *Sqlite) EraseSubject(email string) error {
+	email = util.NormalizeEmail(email)
+	hash := EmailHash(email)
+	tx, err := sq.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE deliveries SET email = ?, last_error = '', status = CASE WHEN status IN (?, ?) THEN ? ELSE status END WHERE "+matchesEmail("email"),
+		hash, DeliveryPending, DeliveryClaimed, DeliverySkipped, email)
+	if err != nil {
+		return err
+	}
+	for _, stmt := range []string{
+		"DELETE FROM subscriber_tags WHERE " + matchesEmail("email"),
+		"DELETE FROM subscriptions WHERE " + matchesEmail("email"),
+		"DELETE FROM suppressions WHERE email = ?",
+	} {
+		if _, err = tx.Exec(stmt, email); err != nil {
+			return err
+		}
+	}
+	if _, err = tx.Exec("DELETE FROM email_changes WHERE "+matchesEmail("old_email")+" OR "+matchesEmail("new_email"), email, email); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("INSERT OR REPLACE INTO suppressions (email, reason) VALUES (?, ?)", hash, "Erased"); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query("SELECT id, report FROM imports WHERE instr(lower(report), ?) > 0", email)
+	if err != nil {
+		return err
+	}
+	reports := make(map[int]string)
+	for rows.Next() {
+		var importID int
+		var report string
+		if err = rows.Scan(&importID, &report); err != nil {
+			rows.Close()
+			return err
+		}
+		reports[importID] = report
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for importID, report := range reports {
+		_, rest, err := splitReport(report, email)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec("UPDATE imports SET report = ? WHERE id = ?", rest, importID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
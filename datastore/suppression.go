@@ -0,0 +1,94 @@
+package datastore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/keur/chillmailer/util"
+)
+
+// Suppression is an address we must never mail, whatever list it is on.
+// Addresses are stored normalized, or hashed once they have been erased.
+type Suppression struct {
+	Email       string    `json:"email"`
+	Reason      string    `json:"reason"`
+	TimeCreated time.Time `json:"time_created"`
+}
+
+// EmailHash is how an erased address is remembered without keeping it.
+func EmailHash(email string) string {
+	sum := sha256.Sum256([]byte(util.NormalizeEmail(email)))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// IsErased reports whether the suppression is the tombstone of an erased address.
+func (s Suppression) IsErased() bool {
+	return strings.HasPrefix(s.Email, "sha256:")
+}
+
+// SuppressedEmails is every suppressed address, for checking many at once.
+type SuppressedEmails map[string]bool
+
+// Has reports whether the address is suppressed, or was erased.
+func (s SuppressedEmails) Has(email string) bool {
+	return s[util.NormalizeEmail(email)] || s[EmailHash(email)]
+}
+
+// notSuppressed leaves out subscriptions for suppressed addresses, and erased
+// ones by their hash.
+const notSuppressed = " AND " + normalizedEmail + " NOT IN (SELECT email FROM suppressions)" +
+	" AND email_hash(subscriptions.email) NOT IN (SELECT email FROM suppressions)"
+
+func (sq *Sqlite) AddSuppression(email string, reason string) error {
+	_, err := sq.Exec("INSERT OR REPLACE INTO suppressions (email, reason) VALUES (?, ?)", util.NormalizeEmail(email), reason)
+	return err
+}
+
+func (sq *Sqlite) RemoveSuppression(email string) error {
+	_, err := sq.Exec("DELETE FROM suppressions WHERE email = ?", util.NormalizeEmail(email))
+	return err
+}
+
+func (sq *Sqlite) IsSuppressed(email string) (bool, error) {
+	var count int
+	err := sq.QueryRow("SELECT COUNT(*) FROM suppressions WHERE email IN (?, ?)", util.NormalizeEmail(email), EmailHash(email)).Scan(&count)
+	return count > 0, err
+}
+
+func (sq *Sqlite) QuerySuppressions() ([]Suppression, error) {
+	rows, err := sq.Query("SELECT email, COALESCE(reason, ''), time_created FROM suppressions ORDER BY time_created DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var suppressions []Suppression
+	for rows.Next() {
+		var s Suppression
+		if err = rows.Scan(&s.Email, &s.Reason, &s.TimeCreated); err != nil {
+			return nil, err
+		}
+		suppressions = append(suppressions, s)
+	}
+	return suppressions, rows.Err()
+}
+
+func (sq *Sqlite) QuerySuppressedEmails() (SuppressedEmails, error) {
+	rows, err := sq.Query("SELECT email FROM suppressions")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	emails := make(SuppressedEmails)
+	for rows.Next() {
+		var email string
+		if err = rows.Scan(&email); err != nil {
+			return nil, err
+		}
+		emails[email] = true
+	}
+	return emails, rows.Err()
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/keur/chillmailer/datastore"
+	"github.com/keur/chillmailer/util"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// adminUser is who is logged in to the admin panel, recorded as the author of
+// drafts and blasts.
+func adminUser(r *http.Request) string {
+	user, _, _ := r.BasicAuth()
+	return user
+}
+
+func draftIDParam(r *http.Request) (int, error) {
+	raw := chi.URLParam(r, "draftID")
+	draftID, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Provided invalid draft: %s", raw))
+	}
+	return draftID, nil
+}
+
+// loadListDraft reads a draft ID from a form or query and checks it belongs to
+// the list. An empty ID is not an error, and returns no draft.
+func loadListDraft(ds datastore.Datastore, raw string, listID int) (*datastore.Draft, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	draftID, err := strconv.Atoi(raw)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Provided invalid draft: %s", raw))
+	}
+	draft, err := ds.GetDraft(draftID)
+	if err != nil {
+		return nil, err
+	}
+	if draft.ListID != listID {
+		return nil, sql.ErrNoRows
+	}
+	return &draft, nil
+}
+
+func draftError(w http.ResponseWriter, err error) {
+	if err == sql.ErrNoRows {
+		util.NotFound(w, "Draft not found")
+	} else {
+		util.UserError(w, err.Error())
+	}
+}
+
+type SaveDraftData struct {
+	ID          int       `json:"id"`
+	TimeUpdated time.Time `json:"time_updated"`
+}
+
+// serveSaveDraft is called by the draft modal as the admin types. The first
+// save creates the draft and returns its ID for the ones after it.
+func serveSaveDraft(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		listName := util.FormValue(r, "list_name")
+		subject := util.FormValue(r, "subject")
+		body := util.FormValue(r, "body")
+		if subject == "" && body == "" {
+			util.UserError(w, "Nothing to save")
+			return
+		}
+		listID, err := ds.GetMailingListID(listName)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if listID == datastore.MailingListNoExist {
+			util.UserError(w, fmt.Sprintf("Provided invalid mailing list: %s", listName))
+			return
+		}
+
+		draft, err := loadListDraft(ds, util.FormValue(r, "draft_id"), listID)
+		if err != nil {
+			draftError(w, err)
+			return
+		}
+		var draftID int
+		if draft == nil {
+			draftID, err = ds.CreateDraft(listID, subject, body, adminUser(r))
+		} else {
+			draftID, err = draft.ID, ds.UpdateDraft(draft.ID, subject, body)
+		}
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		util.WriteJSON(w, SaveDraftData{ID: draftID, TimeUpdated: time.Now()})
+	})
+}
+
+func serveDeleteDraft(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		draftID, err := draftIDParam(r)
+		if err != nil {
+			util.UserError(w, err.Error())
+			return
+		}
+		if err = ds.DeleteDraft(draftID); err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		redirectBack(w, r)
+	})
+}
+
+type ListArchiveData struct {
+	ListName string
+	Blasts   []datastore.Blast
+}
+
+func serveListArchive(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listName := chi.URLParam(r, "listName")
+		listID, err := ds.GetMailingListID(listName)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if listID == datastore.MailingListNoExist {
+			util.UserError(w, fmt.Sprintf("Provided mailing list %s invalid", listName))
+			return
+		}
+		blasts, err := ds.QueryListSentBlasts(listID)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+
+		pageData := ListArchiveData{ListName: listName, Blasts: blasts}
+		tmpl, err := util.NewTemplate("archive.html")
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if err = tmpl.Execute(w, &pageData); err != nil {
+			util.ServerError(w, err)
+			return
+		}
+	})
+}
+
+func serveArchivedBlast(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blastID, err := blastIDParam(r)
+		if err != nil {
+			util.UserError(w, err.Error())
+			return
+		}
+		blast, err := ds.GetBlast(blastID)
+		if err != nil {
+			blastError(w, err)
+			return
+		}
+
+		tmpl, err := util.NewTemplate("archived_blast.html")
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if err = tmpl.Execute(w, &blast); err != nil {
+			util.ServerError(w, err)
+			return
+		}
+	})
+}
+
+// serveDuplicateBlast copies a blast into a new draft on the same list, and
+// opens it for editing.
+func serveDuplicateBlast(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blastID, err := blastIDParam(r)
+		if err != nil {
+			util.UserError(w, err.Error())
+			return
+		}
+		blast, err := ds.GetBlast(blastID)
+		if err != nil {
+			blastError(w, err)
+			return
+		}
+		draftID, err := ds.CreateDraft(blast.ListID, blast.Subject, blast.Body, adminUser(r))
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		redirectLink := filepath.Join("/admin/list/display/", blast.ListName) + fmt.Sprintf("?draft=%d", draftID)
+		http.Redirect(w, r, redirectLink, http.StatusSeeOther)
+	})
+}
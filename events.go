@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/keur/chillmailer/datastore"
+	"github.com/keur/chillmailer/mailer"
+	"github.com/keur/chillmailer/util"
+)
+
+// serveProgressEvents streams blast progress as Server-Sent Events, optionally
+// only for blasts going to the list named in the "list" query parameter. Every connection
+// starts with the current state of unfinished blasts, so clients that
+// reconnect after the server's write timeout don't miss anything.
+func serveProgressEvents(ds datastore.Datastore, hub *mailer.ProgressHub) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			util.ServerError(w, errors.New("Streaming is not supported"))
+			return
+		}
+		listName := r.URL.Query().Get("list")
+		goesToList := blastListFilter(ds, listName)
+
+		// Subscribe before taking the snapshot so nothing falls in between
+		events, unsubscribe := hub.Subscribe()
+		defer unsubscribe()
+
+		blasts, err := ds.QueryBlastsByStatus(datastore.BlastScheduled, datastore.BlastPaused, datastore.BlastSending)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		fmt.Fprint(w, "retry: 2000\n\n")
+
+		for _, blast := range blasts {
+			ok, err := goesToList(blast.ID)
+			if err != nil {
+				return
+			}
+			if !ok {
+				continue
+			}
+			progress, err := ds.QueryBlastProgress(blast.ID)
+			if err != nil {
+				return
+			}
+			writeProgressEvent(w, mailer.ProgressEvent{
+				BlastID:  blast.ID,
+				ListName: blast.ListName,
+				Type:     progressTypeForStatus(blast.Status),
+				Sent:     progress.Sent,
+				Failed:   progress.Failed,
+				Total:    progress.Total,
+			})
+		}
+		flusher.Flush()
+
+		for {
+			select {
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				ok, err := goesToList(event.BlastID)
+				if err != nil {
+					return
+				}
+				if !ok {
+					continue
+				}
+				if err := writeProgressEvent(w, event); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+}
+
+// blastListFilter reports whether a blast goes to the named list, or true for
+// every blast when no list is named. A blast's lists never change, so they are
+// only looked up once per blast.
+func blastListFilter(ds datastore.Datastore, listName string) func(blastID int) (bool, error) {
+	matches := make(map[int]bool)
+	return func(blastID int) (bool, error) {
+		if listName == "" {
+			return true, nil
+		}
+		if match, ok := matches[blastID]; ok {
+			return match, nil
+		}
+		lists, err := ds.QueryBlastLists(blastID)
+		if err != nil {
+			return false, err
+		}
+		matches[blastID] = false
+		for _, list := range lists {
+			if list.ListName == listName {
+				matches[blastID] = true
+				break
+			}
+		}
+		return matches[blastID], nil
+	}
+}
+
+func progressTypeForStatus(status datastore.BlastStatus) mailer.ProgressEventType {
+	switch status {
+	case datastore.BlastSending:
+		return mailer.ProgressStarted
+	case datastore.BlastPaused:
+		return mailer.ProgressPaused
+	default:
+		return mailer.ProgressQueued
+	}
+}
+
+func writeProgressEvent(w http.ResponseWriter, event mailer.ProgressEvent) error {
+	data, err := json.Marshal(&event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+	return err
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/keur/chillmailer/datastore"
+	"github.com/keur/chillmailer/mailer"
+	"github.com/keur/chillmailer/util"
+	"github.com/rs/zerolog/log"
+)
+
+type ExportFormat string
+
+const (
+	ExportCSV  ExportFormat = "csv"
+	ExportJSON ExportFormat = "json"
+)
+
+func parseExportFormat(raw string) (ExportFormat, error) {
+	switch format := ExportFormat(strings.ToLower(raw)); format {
+	case "", ExportCSV:
+		return ExportCSV, nil
+	case ExportJSON:
+		return format, nil
+	default:
+		return "", errors.New(fmt.Sprintf("Unknown export format %s, use csv or json", raw))
+	}
+}
+
+// exportListIDs looks up the list to export, or every list when no name is given.
+func exportListIDs(ds datastore.Datastore, listName string) ([]int, error) {
+	var names []string
+	if listName != "" {
+		names = []string{listName}
+	} else {
+		lists, err := ds.QueryAllMailingLists()
+		if err != nil {
+			return nil, err
+		}
+		for _, list := range lists {
+			names = append(names, list.Name)
+		}
+	}
+	listIDs := make([]int, 0, len(names))
+	for _, name := range names {
+		listID, err := ds.GetMailingListID(name)
+		if err != nil {
+			return nil, err
+		}
+		if listID == datastore.MailingListNoExist {
+			return nil, errors.New(fmt.Sprintf("No mailing list named %s", name))
+		}
+		listIDs = append(listIDs, listID)
+	}
+	return listIDs, nil
+}
+
+// ExportedSubscriberData is how a JSON export shows a subscriber.
+type ExportedSubscriberData struct {
+	List string `json:"list"`
+	SubscriberData
+	Status           datastore.SubscriberStatus `json:"status"`
+	TimeUnsubscribed *time.Time                 `json:"time_unsubscribed,omitempty"`
+	UnsubReason      string                     `json:"unsub_reason,omitempty"`
+	UnsubToken       string                     `json:"unsub_token,omitempty"`
+}
+
+// exportSubscribers writes the subscribers of the lists to w one at a time.
+// Unsubscribe tokens are left out unless withTokens is set, since anyone
+// holding them can unsubscribe people.
+func exportSubscribers(ds datastore.Datastore, listIDs []int, format ExportFormat, withTokens bool, w io.Writer) error {
+	if format == ExportJSON {
+		return exportJSON(ds, listIDs, withTokens, w)
+	}
+
+	// CSV needs a column for every custom field up front
+	fields, err := mailer.ListsFields(ds, listIDs)
+	if err != nil {
+		return err
+	}
+	header := []string{"list", "email", "first_name", "last_name", "status", "time_joined", "time_unsubscribed", "unsub_reason", "tags"}
+	for _, field := range fields {
+		header = append(header, field.Name)
+	}
+	if withTokens {
+		header = append(header, "unsub_token")
+	}
+	out := csv.NewWriter(w)
+	if err = out.Write(header); err != nil {
+		return err
+	}
+	err = ds.ExportSubscribers(listIDs, func(sub datastore.ExportedSubscriber) error {
+		record := []string{
+			sub.ListName,
+			sub.Email,
+			sub.FirstName,
+			sub.LastName,
+			string(sub.Status),
+			sub.TimeJoined.UTC().Format(time.RFC3339),
+			"",
+			sub.UnsubReason,
+			strings.Join(sub.Tags, ","),
+		}
+		if sub.IsUnsubscribed() {
+			record[6] = sub.TimeUnsubscribed.UTC().Format(time.RFC3339)
+		}
+		for _, field := range fields {
+			record = append(record, sub.Fields.Format(field.Name))
+		}
+		if withTokens {
+			record = append(record, sub.UnsubToken)
+		}
+		return out.Write(record)
+	})
+	if err != nil {
+		return err
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// exportJSON writes an array without holding it all in memory.
+func exportJSON(ds datastore.Datastore, listIDs []int, withTokens bool, w io.Writer) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	first := true
+	err := ds.ExportSubscribers(listIDs, func(sub datastore.ExportedSubscriber) error {
+		if !first {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		first = false
+		data := ExportedSubscriberData{
+			List: sub.ListName,
+			SubscriberData: SubscriberData{
+				Email:      sub.Email,
+				FirstName:  sub.FirstName,
+				LastName:   sub.LastName,
+				TimeJoined: sub.TimeJoined,
+				Fields:     sub.Fields,
+				Tags:       sub.Tags,
+			},
+			Status:      sub.Status,
+			UnsubReason: sub.UnsubReason,
+		}
+		if sub.IsUnsubscribed() {
+			data.TimeUnsubscribed = &sub.TimeUnsubscribed
+		}
+		if withTokens {
+			data.UnsubToken = sub.UnsubToken
+		}
+		return encoder.Encode(data)
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "]\n")
+	return err
+}
+
+// serveExport downloads the subscribers of one list, or of every list when
+// no list is named.
+func serveExport(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listName := chi.URLParam(r, "listName")
+		format, err := parseExportFormat(r.URL.Query().Get("format"))
+		if err != nil {
+			util.UserError(w, err.Error())
+			return
+		}
+		listIDs, err := exportListIDs(ds, listName)
+		if err != nil {
+			util.UserError(w, err.Error())
+			return
+		}
+
+		filename := "subscribers"
+		if listName != "" {
+			filename = util.ReplaceWhitespaceWith(listName, "_") + "-subscribers"
+		}
+		if format == ExportJSON {
+			w.Header().Set("Content-Type", "application/json")
+		} else {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, filename, format))
+		// Headers are gone by now, so all we can do is stop
+		if err = exportSubscribers(ds, listIDs, format, util.StringIsYes(r.URL.Query().Get("tokens")), w); err != nil {
+			log.Error().Err(err).Msg("Export stopped early")
+		}
+	})
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/keur/chillmailer/datastore"
+	"github.com/keur/chillmailer/mailer"
+	"github.com/keur/chillmailer/util"
+)
+
+const maxFieldLength = 500
+
+// parseSubscriberFields reads a value for each of the list's custom fields
+// from the submitted form, where it is named after the field.
+func parseSubscriberFields(r *http.Request, fields []datastore.ListField) (datastore.Fields, error) {
+	values := make(datastore.Fields)
+	for _, field := range fields {
+		raw := util.FormValue(r, field.Name)
+		if len(raw) > maxFieldLength {
+			return nil, errors.New(fmt.Sprintf("Field %s is too long", field.Name))
+		}
+		value, err := field.Parse(raw)
+		if err != nil {
+			return nil, err
+		}
+		if value != nil {
+			values[field.Name] = value
+		}
+	}
+	return values, nil
+}
+
+// sampleMergeData is the sample subscriber for a blast to the lists, with
+// their custom fields.
+func sampleMergeData(ds datastore.Datastore, listName string, listIDs ...int) (mailer.MergeData, error) {
+	fields, err := mailer.ListsFields(ds, listIDs)
+	if err != nil {
+		return mailer.MergeData{}, err
+	}
+	return mailer.SampleMergeData(listName, fields), nil
+}
+
+func listDisplayLink(listName string) string {
+	return filepath.Join("/admin/list/display/", listName)
+}
+
+func serveCreateListField(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listName := chi.URLParam(r, "listName")
+		err := r.ParseForm()
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		listID, err := ds.GetMailingListID(listName)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if listID == datastore.MailingListNoExist {
+			util.UserError(w, fmt.Sprintf("Provided invalid mailing list: %s", listName))
+			return
+		}
+
+		name := strings.ToLower(util.FormValue(r, "name"))
+		fieldType := datastore.FieldType(util.FormValue(r, "type"))
+		if err = datastore.ValidateField(name, fieldType); err != nil {
+			util.UserError(w, err.Error())
+			return
+		}
+		if err = ds.CreateListField(listID, name, fieldType, util.FormValue(r, "required") == "on"); err != nil {
+			if datastore.IsUniqueConstraintError(err) {
+				util.UserError(w, fmt.Sprintf("List %s already has a field named %s", listName, name))
+			} else {
+				util.ServerError(w, err)
+			}
+			return
+		}
+		http.Redirect(w, r, listDisplayLink(listName), http.StatusSeeOther)
+	})
+}
+
+// serveDeleteListField removes a custom field, unless a pending blast or saved
+// segment still needs it.
+func serveDeleteListField(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listName := chi.URLParam(r, "listName")
+		listID, err := ds.GetMailingListID(listName)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if listID == datastore.MailingListNoExist {
+			util.UserError(w, fmt.Sprintf("Provided invalid mailing list: %s", listName))
+			return
+		}
+		fieldName := chi.URLParam(r, "fieldName")
+		blasts, err := mailer.BlastsUsingField(ds, listID, fieldName)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if len(blasts) > 0 {
+			util.UserError(w, fmt.Sprintf("Field %s is used by the pending blast \"%s\", edit or cancel it first", fieldName, blasts[0].Subject))
+			return
+		}
+		segments, err := ds.QueryListSegments(listID)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		for _, segment := range segments {
+			if segment.Rules.UsesField(fieldName) {
+				util.UserError(w, fmt.Sprintf("Field %s is used by the segment \"%s\", delete it first", fieldName, segment.Name))
+				return
+			}
+		}
+		if err = ds.DeleteListField(listID, fieldName); err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		http.Redirect(w, r, listDisplayLink(listName), http.StatusSeeOther)
+	})
+}
+
+// serveUpdateSubscriberFields saves the custom field values an admin edited
+// on the list page.
+func serveUpdateSubscriberFields(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listName := chi.URLParam(r, "listName")
+		err := r.ParseForm()
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		listID, err := ds.GetMailingListID(listName)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if listID == datastore.MailingListNoExist {
+			util.UserError(w, fmt.Sprintf("Provided invalid mailing list: %s", listName))
+			return
+		}
+		fields, err := ds.QueryListFields(listID)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		values, err := parseSubscriberFields(r, fields)
+		if err != nil {
+			util.UserError(w, err.Error())
+			return
+		}
+
+		err = ds.UpdateSubscriberFields(listID, util.FormValue(r, "email"), values)
+		if err == sql.ErrNoRows {
+			util.NotFound(w, "Subscriber not found")
+			return
+		} else if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		http.Redirect(w, r, listDisplayLink(listName), http.StatusSeeOther)
+	})
+}
+
+// SubscriberData is how the API shows a subscriber. It leaves out the
+// unsubscribe token.
+type SubscriberData struct {
+	Email      string           `json:"email"`
+	FirstName  string           `json:"first_name"`
+	LastName   string           `json:"last_name"`
+	TimeJoined time.Time        `json:"time_joined"`
+	Fields     datastore.Fields `json:"fields"`
+	Tags       []string         `json:"tags"`
+}
+
+func serveSubscribersAPI(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listName := chi.URLParam(r, "listName")
+		listID, err := ds.GetMailingListID(listName)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if listID == datastore.MailingListNoExist {
+			util.NotFound(w, fmt.Sprintf("Provided invalid mailing list: %s", listName))
+			return
+		}
+		fields, err := ds.QueryListFields(listID)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		query := r.URL.Query()
+		filter := datastore.SubscriberFilter{IncludeTags: query["tag"]}
+		query.Del("tag")
+		if filter.Conditions, err = datastore.ParseFieldConditions(query, fields); err != nil {
+			util.UserError(w, err.Error())
+			return
+		}
+
+		subs, err := ds.QueryListSubscribers(listID, filter)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		data := make([]SubscriberData, len(subs))
+		for i, sub := range subs {
+			data[i] = SubscriberData{
+				Email:      sub.Email,
+				FirstName:  sub.FirstName,
+				LastName:   sub.LastName,
+				TimeJoined: sub.TimeJoined,
+				Fields:     sub.Fields,
+				Tags:       sub.Tags,
+			}
+		}
+		util.WriteJSON(w, data)
+	})
+}
@@ -3,13 +3,17 @@ module github.com/keur/chillmailer
 go 1.19
 
 require (
-	github.com/go-chi/chi/v5 v5.0.10 // indirect
-	github.com/google/uuid v1.3.1 // indirect
+	github.com/go-chi/chi/v5 v5.0.10
+	github.com/google/uuid v1.3.1
+	github.com/mattn/go-sqlite3 v1.14.17
+	github.com/rs/zerolog v1.30.0
+	github.com/yuin/goldmark v1.7.4
+	golang.org/x/time v0.3.0
+)
+
+require (
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.19 // indirect
-	github.com/mattn/go-sqlite3 v1.14.17 // indirect
 	github.com/rs/xid v1.5.0 // indirect
-	github.com/rs/zerolog v1.30.0 // indirect
 	golang.org/x/sys v0.11.0 // indirect
-	golang.org/x/time v0.3.0 // indirect
 )
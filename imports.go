@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/keur/chillmailer/datastore"
+	"github.com/keur/chillmailer/util"
+)
+
+// importBatchSize is how many subscribers each import transaction adds.
+const importBatchSize = 500
+
+// Columns can be mapped to these, or to one of the list's custom fields.
+const (
+	importEmail     = "email"
+	importFirstName = "first_name"
+	importLastName  = "last_name"
+	importTags      = "tags"
+)
+
+type ImportOptions struct {
+	// Delimiter is ',' or '\t', or zero to guess from the header
+	Delimiter rune
+	// Mapping says what each column holds, by header, for columns whose header
+	// doesn't already name what they hold. An empty target skips the column.
+	Mapping map[string]string
+	DryRun  bool
+}
+
+// ParseImportMapping reads a mapping written as header=target pairs,
+// separated by commas or new lines.
+func ParseImportMapping(raw string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	for _, pair := range strings.FieldsFunc(raw, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		header, target, found := strings.Cut(pair, "=")
+		if !found {
+			return nil, errors.New(fmt.Sprintf("Invalid column mapping %s, use header=target", strings.TrimSpace(pair)))
+		}
+		mapping[strings.ToLower(strings.TrimSpace(header))] = strings.ToLower(strings.TrimSpace(target))
+	}
+	return mapping, nil
+}
+
+// ImportRejection is a row that wasn't imported, and why.
+type ImportRejection struct {
+	Row    int
+	Email  string
+	Reason string
+	Record []string
+}
+
+type ImportResult struct {
+	Header []string
+	Total  int
+	// Imported counts the rows that were added, or would be on a dry run
+	Imported int
+	Rejected []ImportRejection
+}
+
+// Report writes the rejected rows as CSV, each with its row number and
+// reason ahead of the original columns.
+func (result ImportResult) Report(w io.Writer) error {
+	out := csv.NewWriter(w)
+	if err := out.Write(append([]string{"row", "email", "reason"}, result.Header...)); err != nil {
+		return err
+	}
+	for _, r := range result.Rejected {
+		if err := out.Write(append([]string{strconv.Itoa(r.Row), r.Email, r.Reason}, r.Record...)); err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// guessDelimiter picks tabs over commas if the header has more of them.
+func guessDelimiter(input *bufio.Reader) rune {
+	peeked, _ := input.Peek(4096)
+	header, _, _ := bytes.Cut(peeked, []byte("\n"))
+	if bytes.Count(header, []byte("\t")) > bytes.Count(header, []byte(",")) {
+		return '\t'
+	}
+	return ','
+}
+
+// importColumns works out what each column holds, from its header or the mapping.
+func importColumns(header []string, mapping map[string]string, fields []datastore.ListField) ([]string, error) {
+	known := map[string]bool{importEmail: true, importFirstName: true, importLastName: true, importTags: true}
+	for _, field := range fields {
+		known[field.Name] = true
+	}
+	aliases := map[string]string{"e_mail": importEmail, "email_address": importEmail, "firstname": importFirstName, "lastname": importLastName}
+
+	columns := make([]string, len(header))
+	mapped := make(map[string]bool)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		target, ok := mapping[name]
+		if !ok {
+			target = strings.NewReplacer(" ", "_", "-", "_").Replace(name)
+			if alias, ok := aliases[target]; ok {
+				target = alias
+			}
+			if !known[target] {
+				// Columns nobody asked for are skipped
+				continue
+			}
+		}
+		if target == "" {
+			continue
+		}
+		if !known[target] {
+			return nil, errors.New(fmt.Sprintf("Column %s is mapped to %s, which is not a custom field of this list", header[i], target))
+		}
+		if mapped[target] {
+			return nil, errors.New(fmt.Sprintf("More than one column holds %s", target))
+		}
+		mapped[target] = true
+		columns[i] = target
+	}
+	if !mapped[importEmail] {
+		return nil, errors.New("No column holds the email address, map one with header=email")
+	}
+	for _, field := range fields {
+		if field.Required && !mapped[field.Name] {
+			return nil, errors.New(fmt.Sprintf("Field %s is required, but no column holds it", field.Name))
+		}
+	}
+	return columns, nil
+}
+
+// importSubscribers adds subscribers to a list from a CSV or TSV file with a
+// header row. Invalid, suppressed and duplicate addresses are rejected rather
+// than stopping the import. Valid rows are added in batches, each in its own
+// transaction, unless it's a dry run.
+func importSubscribers(ds datastore.Datastore, listID int, input io.Reader, opts ImportOptions) (ImportResult, error) {
+	var result ImportResult
+	buffered := bufio.NewReader(input)
+	reader := csv.NewReader(buffered)
+	reader.Comma = opts.Delimiter
+	if reader.Comma == 0 {
+		reader.Comma = guessDelimiter(buffered)
+	}
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return result, errors.New("The file is empty")
+	} else if err != nil {
+		return result, err
+	}
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	}
+	result.Header = header
+
+	fields, err := ds.QueryListFields(listID)
+	if err != nil {
+		return result, err
+	}
+	fieldsByName := make(map[string]datastore.ListField, len(fields))
+	for _, field := range fields {
+		fieldsByName[field.Name] = field
+	}
+	columns, err := importColumns(header, opts.Mapping, fields)
+	if err != nil {
+		return result, err
+	}
+	subscribed, err := ds.QueryListEmails(listID)
+	if err != nil {
+		return result, err
+	}
+	suppressed, err := ds.QuerySuppressedEmails()
+	if err != nil {
+		return result, err
+	}
+
+	var batch []datastore.SubscriberInfo
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if opts.DryRun {
+			result.Imported += len(batch)
+		} else {
+			imported, err := ds.ImportSubscribers(listID, batch)
+			if err != nil {
+				return err
+			}
+			result.Imported += imported
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	// Rows are numbered by the line they start on, as a spreadsheet would show them
+	seen := make(map[string]int)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		result.Total++
+		var parseError *csv.ParseError
+		if errors.As(err, &parseError) {
+			result.Rejected = append(result.Rejected, ImportRejection{Row: parseError.StartLine, Reason: parseError.Err.Error(), Record: record})
+			continue
+		} else if err != nil {
+			return result, err
+		}
+		row, _ := reader.FieldPos(0)
+
+		sub, reason := importRecord(record, columns, fieldsByName)
+		email := util.NormalizeEmail(sub.Email)
+		if reason == "" {
+			active, found := subscribed[email]
+			switch {
+			case suppressed.Has(email):
+				reason = "Suppressed"
+			case found && active:
+				reason = "Already subscribed"
+			case found:
+				reason = "Unsubscribed"
+			case seen[email] != 0:
+				reason = fmt.Sprintf("Duplicate of row %d", seen[email])
+			}
+		}
+		if reason != "" {
+			result.Rejected = append(result.Rejected, ImportRejection{Row: row, Email: sub.Email, Reason: reason, Record: record})
+			continue
+		}
+
+		seen[email] = row
+		batch = append(batch, sub)
+		if len(batch) == importBatchSize {
+			if err = flush(); err != nil {
+				return result, err
+			}
+		}
+	}
+	return result, flush()
+}
+
+// importRecord reads a subscriber from one row, or why it can't be imported.
+func importRecord(record []string, columns []string, fields map[string]datastore.ListField) (datastore.SubscriberInfo, string) {
+	sub := datastore.SubscriberInfo{Fields: make(datastore.Fields)}
+	values := make(map[string]string, len(columns))
+	for i, target := range columns {
+		if target != "" && i < len(record) {
+			values[target] = strings.TrimSpace(record[i])
+		}
+	}
+
+	sub.Email = values[importEmail]
+	if sub.Email == "" || html.EscapeString(sub.Email) != sub.Email || !util.IsEmailValid(sub.Email) {
+		return sub, "Invalid email address"
+	}
+	sub.FirstName, sub.LastName = values[importFirstName], values[importLastName]
+	if len(sub.FirstName) > maxNameLength || len(sub.LastName) > maxNameLength {
+		return sub, "Name is too long"
+	}
+	var err error
+	if sub.Tags, err = datastore.ParseTags(values[importTags]); err != nil {
+		return sub, err.Error()
+	}
+	for name, field := range fields {
+		if len(values[name]) > maxFieldLength {
+			return sub, fmt.Sprintf("Field %s is too long", name)
+		}
+		value, err := field.Parse(values[name])
+		if err != nil {
+			return sub, err.Error()
+		}
+		if value != nil {
+			sub.Fields[name] = value
+		}
+	}
+	return sub, ""
+}
+
+// ImportPageData is the import form, and the outcome of an import once submitted.
+type ImportPageData struct {
+	ListName string
+	Fields   []datastore.ListField
+	Error    string
+	// Mapping is what was submitted, kept for another try
+	Mapping string
+	Result  *ImportResult
+	DryRun  bool
+	// ReportID is the stored import whose report can be downloaded
+	ReportID int
+}
+
+func renderImportPage(w http.ResponseWriter, data *ImportPageData) {
+	tmpl, err := util.NewTemplate("import.html")
+	if err != nil {
+		util.ServerError(w, err)
+		return
+	}
+	if data.Error != "" {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	if err = tmpl.Execute(w, data); err != nil {
+		util.ServerError(w, err)
+	}
+}
+
+func serveImportPage(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listName := chi.URLParam(r, "listName")
+		listID, err := ds.GetMailingListID(listName)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if listID == datastore.MailingListNoExist {
+			util.UserError(w, fmt.Sprintf("Provided invalid mailing list: %s", listName))
+			return
+		}
+		fields, err := ds.QueryListFields(listID)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		renderImportPage(w, &ImportPageData{ListName: listName, Fields: fields})
+	})
+}
+
+// maxImportSize is the largest file the admin panel takes. Bigger ones can
+// be imported from the command line.
+const maxImportSize = 32 << 20
+
+func serveImport(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listName := chi.URLParam(r, "listName")
+		listID, err := ds.GetMailingListID(listName)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if listID == datastore.MailingListNoExist {
+			util.UserError(w, fmt.Sprintf("Provided invalid mailing list: %s", listName))
+			return
+		}
+		fields, err := ds.QueryListFields(listID)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		pageData := ImportPageData{ListName: listName, Fields: fields}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+		if err = r.ParseMultipartForm(maxImportSize); err != nil {
+			pageData.Error = "Could not read the upload, files can be up to 32MB"
+			renderImportPage(w, &pageData)
+			return
+		}
+		file, upload, err := r.FormFile("file")
+		if err != nil {
+			pageData.Error = "Choose a file to import"
+			renderImportPage(w, &pageData)
+			return
+		}
+		defer file.Close()
+
+		opts := ImportOptions{DryRun: util.FormValue(r, "dry_run") == "on"}
+		switch util.FormValue(r, "delimiter") {
+		case "comma":
+			opts.Delimiter = ','
+		case "tab":
+			opts.Delimiter = '\t'
+		default:
+			if strings.EqualFold(filepath.Ext(upload.Filename), ".tsv") {
+				opts.Delimiter = '\t'
+			}
+		}
+		pageData.Mapping = util.FormValue(r, "mapping")
+		if opts.Mapping, err = ParseImportMapping(pageData.Mapping); err != nil {
+			pageData.Error = err.Error()
+			renderImportPage(w, &pageData)
+			return
+		}
+
+		result, err := importSubscribers(ds, listID, file, opts)
+		if err != nil {
+			pageData.Error = err.Error()
+			if result.Total > 0 {
+				// Batches already added stay added
+				pageData.Error = fmt.Sprintf("Import stopped after %d rows: %s", result.Total, err)
+				pageData.Result = &result
+			}
+			renderImportPage(w, &pageData)
+			return
+		}
+		pageData.Result, pageData.DryRun = &result, opts.DryRun
+
+		if len(result.Rejected) > 0 {
+			report := new(bytes.Buffer)
+			if err = result.Report(report); err != nil {
+				util.ServerError(w, err)
+				return
+			}
+			pageData.ReportID, err = ds.CreateImport(datastore.Import{
+				ListID:   listID,
+				Author:   adminUser(r),
+				DryRun:   opts.DryRun,
+				Total:    result.Total,
+				Imported: result.Imported,
+				Rejected: len(result.Rejected),
+				Report:   report.String(),
+			})
+			if err != nil {
+				util.ServerError(w, err)
+				return
+			}
+		}
+		renderImportPage(w, &pageData)
+	})
+}
+
+// serveImportReport downloads the rejected rows of an import as CSV.
+func serveImportReport(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		importID, err := strconv.Atoi(chi.URLParam(r, "importID"))
+		if err != nil {
+			util.NotFound(w, "Import not found")
+			return
+		}
+		listID, err := ds.GetMailingListID(chi.URLParam(r, "listName"))
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		report, err := ds.GetImport(importID)
+		if err == sql.ErrNoRows || (err == nil && report.ListID != listID) {
+			util.NotFound(w, "Import not found")
+			return
+		} else if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="import-%d-rejected.csv"`, report.ID))
+		io.WriteString(w, report.Report)
+	})
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/keur/chillmailer/datastore"
+	"github.com/keur/chillmailer/mailer"
+	"github.com/keur/chillmailer/util"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// sampleLayoutBody is the message shown when previewing a layout.
+const sampleLayoutBody = `# Sample heading
+
+This is how a blast looks in this layout, with **bold**, *italics* and a
+[link](https://example.com).
+
+- A list
+- of items`
+
+type ListLayoutData struct {
+	ListName string
+	HTML     string
+	Text     string
+	// Custom is true when the list has a layout of its own
+	Custom  bool
+	Error   string
+	Preview *mailer.Message
+}
+
+func renderListLayoutPage(w http.ResponseWriter, pageData *ListLayoutData) {
+	tmpl, err := util.NewTemplate("layout.html")
+	if err != nil {
+		util.ServerError(w, err)
+		return
+	}
+	if pageData.Error != "" {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	if err = tmpl.Execute(w, pageData); err != nil {
+		util.ServerError(w, err)
+		return
+	}
+}
+
+func serveListLayout(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listName := chi.URLParam(r, "listName")
+		listID, err := ds.GetMailingListID(listName)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if listID == datastore.MailingListNoExist {
+			util.UserError(w, fmt.Sprintf("Provided mailing list %s invalid", listName))
+			return
+		}
+		htmlLayout, textLayout, err := ds.GetListLayout(listID)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		defaultHTML, defaultText, err := mailer.DefaultLayoutSource()
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+
+		pageData := ListLayoutData{ListName: listName, HTML: htmlLayout, Text: textLayout, Custom: htmlLayout != "" || textLayout != ""}
+		if pageData.HTML == "" {
+			pageData.HTML = defaultHTML
+		}
+		if pageData.Text == "" {
+			pageData.Text = defaultText
+		}
+		renderListLayoutPage(w, &pageData)
+	})
+}
+
+// serveSaveListLayout validates, previews, saves or resets a list's layout,
+// depending on which button was pressed.
+func serveSaveListLayout(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listName := chi.URLParam(r, "listName")
+		err := r.ParseForm()
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		listID, err := ds.GetMailingListID(listName)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if listID == datastore.MailingListNoExist {
+			util.UserError(w, fmt.Sprintf("Provided invalid mailing list: %s", listName))
+			return
+		}
+
+		action := util.FormValue(r, "action")
+		if action == "reset" {
+			if err = ds.SetListLayout(listID, "", ""); err != nil {
+				util.ServerError(w, err)
+				return
+			}
+			http.Redirect(w, r, filepath.Join("/admin/list/layout/", listName), http.StatusSeeOther)
+			return
+		}
+
+		// Layouts identical to the defaults are not stored, so the list keeps
+		// following the template files
+		htmlLayout, textLayout := r.FormValue("html_layout"), r.FormValue("text_layout")
+		defaultHTML, defaultText, err := mailer.DefaultLayoutSource()
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if normalizeNewlines(htmlLayout) == normalizeNewlines(defaultHTML) {
+			htmlLayout = ""
+		}
+		if normalizeNewlines(textLayout) == normalizeNewlines(defaultText) {
+			textLayout = ""
+		}
+
+		pageData := ListLayoutData{ListName: listName, HTML: r.FormValue("html_layout"), Text: r.FormValue("text_layout")}
+		layout, err := mailer.ParseLayout(htmlLayout, textLayout)
+		if err != nil {
+			pageData.Error = err.Error()
+			renderListLayoutPage(w, &pageData)
+			return
+		}
+
+		if action == "preview" {
+			fromEmail, err := mailer.FromAddressForList(listName)
+			if err != nil {
+				util.ServerError(w, err)
+				return
+			}
+			subscriber, err := sampleSubscriber(ds, listID)
+			if err != nil {
+				util.ServerError(w, err)
+				return
+			}
+			pageData.Preview, err = mailer.RenderMessage(mailer.Email{
+				From:            fromEmail,
+				To:              subscriber.Email,
+				Subject:         "Sample subject",
+				Body:            sampleLayoutBody,
+				UnsubscribeLink: mailer.UnsubscribeLink(util.GetWebRoot(r), listName, subscriber.Email, subscriber.UnsubToken, 0),
+				Layout:          layout,
+			})
+			if err != nil {
+				pageData.Error = err.Error()
+			}
+			renderListLayoutPage(w, &pageData)
+			return
+		}
+
+		if err = ds.SetListLayout(listID, htmlLayout, textLayout); err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		redirectLink := filepath.Join("/admin/list/display/", listName)
+		http.Redirect(w, r, redirectLink, http.StatusSeeOther)
+	})
+}
+
+// normalizeNewlines undoes the CRLF line endings browsers submit textareas with.
+func normalizeNewlines(s string) string {
+	return strings.ReplaceAll(s, "\r\n", "\n")
+}
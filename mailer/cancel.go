@@ -10,47 +10,56 @@ type CancellableContext struct {
 	Cancel context.CancelFunc
 }
 
+// MailCanceller tracks a cancellable context for every blast that is waiting
+// or sending, keyed by blast ID.
 type MailCanceller struct {
 	Mutex     *sync.Mutex
-	CancelMap map[string]CancellableContext
+	CancelMap map[int]CancellableContext
 }
 
 func NewMailCanceller() *MailCanceller {
-	m := make(map[string]CancellableContext)
+	m := make(map[int]CancellableContext)
 	return &MailCanceller{Mutex: &sync.Mutex{}, CancelMap: m}
 }
 
-func (mc *MailCanceller) ContextForMailingList(list string) context.Context {
+// ContextForBlast hands out a fresh context for a blast. Any context previously
+// handed out for it is cancelled, so only the newest waiter stays alive.
+func (mc *MailCanceller) ContextForBlast(blastID int) context.Context {
 	mc.Mutex.Lock()
 	defer mc.Mutex.Unlock()
 
-	cc, ok := mc.CancelMap[list]
-	if ok {
-		return cc.Ctx
-	} else {
-		newCtx, cancel := context.WithCancel(context.Background())
-		mc.CancelMap[list] = CancellableContext{Ctx: newCtx, Cancel: cancel}
-		return newCtx
+	if cc, ok := mc.CancelMap[blastID]; ok {
+		cc.Cancel()
 	}
+	newCtx, cancel := context.WithCancel(context.Background())
+	mc.CancelMap[blastID] = CancellableContext{Ctx: newCtx, Cancel: cancel}
+	return newCtx
 }
 
-func (mc *MailCanceller) CancelMailingList(list string) {
+func (mc *MailCanceller) CancelBlast(blastID int) {
 	mc.Mutex.Lock()
 	defer mc.Mutex.Unlock()
 
-	cc, ok := mc.CancelMap[list]
+	cc, ok := mc.CancelMap[blastID]
 	if !ok {
 		return
 	}
 	cc.Cancel()
 
-	delete(mc.CancelMap, list)
+	delete(mc.CancelMap, blastID)
 }
 
-func (mc *MailCanceller) ListHasContext(list string) bool {
+// FinishBlast cleans up after a blast once whoever holds ctx is done with it.
+// Entries that have since been replaced by a newer context are left alone.
+func (mc *MailCanceller) FinishBlast(blastID int, ctx context.Context) {
 	mc.Mutex.Lock()
 	defer mc.Mutex.Unlock()
 
-	_, ok := mc.CancelMap[list]
-	return ok
+	cc, ok := mc.CancelMap[blastID]
+	if !ok || cc.Ctx != ctx {
+		return
+	}
+	cc.Cancel()
+
+	delete(mc.CancelMap, blastID)
 }
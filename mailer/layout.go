@@ -0,0 +1,125 @@
+package mailer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/keur/chillmailer/datastore"
+	"github.com/keur/chillmailer/util"
+)
+
+const (
+	defaultHTMLLayout = "email.html"
+	defaultTextLayout = "email.txt"
+)
+
+// Layout wraps rendered blast bodies in a list's own branding. A nil Layout,
+// or a nil template within one, falls back to the default template files.
+type Layout struct {
+	HTML *template.Template
+	Text *template.Template
+}
+
+// layoutSample fills in a layout to check it before it is saved.
+var layoutSample = EmailData{
+	Subject:         "Sample subject",
+	Body:            "chillmailer-sample-body",
+	UnsubscribeLink: "https://example.com/unsubscribe/sample",
+	PreferencesLink: "https://example.com/preferences/sample",
+	WebLink:         "https://example.com/view/sample",
+}
+
+// ParseLayout checks and compiles a list's layout sources. An empty source
+// keeps the default for that part. Each layout must place both the message
+// body and the unsubscribe link.
+func ParseLayout(htmlSource string, textSource string) (*Layout, error) {
+	layout := &Layout{}
+	var err error
+	if layout.HTML, err = parseLayoutPart("HTML", defaultHTMLLayout, htmlSource); err != nil {
+		return nil, err
+	}
+	if layout.Text, err = parseLayoutPart("Text", defaultTextLayout, textSource); err != nil {
+		return nil, err
+	}
+	return layout, nil
+}
+
+func parseLayoutPart(kind string, name string, source string) (*template.Template, error) {
+	if strings.TrimSpace(source) == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New(name).Parse(source)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s layout is invalid: %s", kind, err))
+	}
+	output, err := executeLayout(tmpl, layoutSample)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s layout is invalid: %s", kind, err))
+	}
+	if !strings.Contains(output, layoutSample.Body) {
+		return nil, errors.New(fmt.Sprintf("%s layout must include the message with {{.Body}}", kind))
+	}
+	if !strings.Contains(output, layoutSample.UnsubscribeLink) {
+		return nil, errors.New(fmt.Sprintf("%s layout must include the unsubscribe link with {{.UnsubscribeLink}}", kind))
+	}
+	return tmpl, nil
+}
+
+// ListLayout loads the layout a list's blasts are sent with.
+func ListLayout(ds datastore.Datastore, listID int) (*Layout, error) {
+	htmlSource, textSource, err := ds.GetListLayout(listID)
+	if err != nil {
+		return nil, err
+	}
+	return ParseLayout(htmlSource, textSource)
+}
+
+// DefaultLayoutSource returns the default template files, as a starting point
+// for a list's own layout.
+func DefaultLayoutSource() (string, string, error) {
+	dir, _ := os.Getwd()
+	htmlSource, err := os.ReadFile(filepath.Join(dir, "template", defaultHTMLLayout))
+	if err != nil {
+		return "", "", err
+	}
+	textSource, err := os.ReadFile(filepath.Join(dir, "template", defaultTextLayout))
+	if err != nil {
+		return "", "", err
+	}
+	return string(htmlSource), string(textSource), nil
+}
+
+func (l *Layout) renderHTML(data EmailData) (string, error) {
+	if l == nil || l.HTML == nil {
+		return renderDefaultLayout(defaultHTMLLayout, data)
+	}
+	return executeLayout(l.HTML, data)
+}
+
+func (l *Layout) renderText(data EmailData) (string, error) {
+	if l == nil || l.Text == nil {
+		return renderDefaultLayout(defaultTextLayout, data)
+	}
+	return executeLayout(l.Text, data)
+}
+
+func renderDefaultLayout(filename string, data EmailData) (string, error) {
+	tmpl, err := util.NewTemplate(filename)
+	if err != nil {
+		return "", err
+	}
+	return executeLayout(tmpl, data)
+}
+
+func executeLayout(tmpl *template.Template, data EmailData) (string, error) {
+	buffer := new(bytes.Buffer)
+	if err := tmpl.Execute(buffer, &data); err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
@@ -0,0 +1,50 @@
+package mailer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseLayoutValidates(t *testing.T) {
+	for _, tc := range []struct {
+		html string
+		text string
+		err  string
+	}{
+		{html: "<div>{{.Body}}", err: "must include the unsubscribe link"},
+		{html: "<a href=\"{{.UnsubscribeLink}}\">unsubscribe</a>", err: "must include the message"},
+		{html: "{{.Body", err: "HTML layout is invalid"},
+		{html: "{{.Body}} {{.UnsubscribeLink}} {{.Missing}}", err: "HTML layout is invalid"},
+		{text: "{{.Body}}", err: "Text layout must include the unsubscribe link"},
+		{html: "{{.Body}} {{.UnsubscribeLink}}", text: "{{.Body}}\n{{.UnsubscribeLink}}"},
+		{},
+	} {
+		_, err := ParseLayout(tc.html, tc.text)
+		if tc.err == "" && err != nil {
+			t.Errorf("ParseLayout(%q, %q) failed: %s", tc.html, tc.text, err)
+		} else if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("ParseLayout(%q, %q) = %v, want error containing %q", tc.html, tc.text, err, tc.err)
+		}
+	}
+}
+
+func TestRenderMessageUsesListLayout(t *testing.T) {
+	layout, err := ParseLayout(`<div class="brand">{{.Body}}<a href="{{.UnsubscribeLink}}">Leave</a></div>`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	email := testEmail
+	email.Layout = layout
+	message, err := RenderMessage(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.HTML != `<div class="brand"><p>Hello</p>
+<a href="http://localhost/unsubscribe">Leave</a></div>` {
+		t.Errorf("HTML part did not use the list layout:\n%s", message.HTML)
+	}
+	// The text part falls back to the default template
+	if !strings.Contains(message.Text, "Unsubscribe here:\nhttp://localhost/unsubscribe") {
+		t.Errorf("text part did not use the default layout:\n%s", message.Text)
+	}
+}
@@ -0,0 +1,253 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"strings"
+	"sync"
+
+	"github.com/keur/chillmailer/util"
+	"github.com/rs/zerolog/log"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/renderer"
+	goldmarkhtml "github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+	goldmarkutil "github.com/yuin/goldmark/util"
+)
+
+// RawHTMLMode decides what happens to HTML written straight into a blast body.
+type RawHTMLMode string
+
+const (
+	// RawHTMLEscape shows the HTML as text, so readers see exactly what was typed
+	RawHTMLEscape RawHTMLMode = "escape"
+	// RawHTMLStrip drops the HTML from both parts
+	RawHTMLStrip RawHTMLMode = "strip"
+	// RawHTMLAllow passes the HTML through untouched. Only use it if you trust
+	// everyone with access to the admin panel.
+	RawHTMLAllow RawHTMLMode = "allow"
+)
+
+func RawHTMLModeFromEnv() RawHTMLMode {
+	mode := RawHTMLMode(strings.ToLower(util.GetenvOr("MARKDOWN_RAW_HTML", string(RawHTMLEscape))))
+	switch mode {
+	case RawHTMLEscape, RawHTMLStrip, RawHTMLAllow:
+		return mode
+	}
+	log.Warn().Msgf("Invalid MARKDOWN_RAW_HTML %s, escaping raw HTML", mode)
+	return RawHTMLEscape
+}
+
+// Markdown turns blast bodies written in CommonMark into the HTML and plain
+// text parts of an email.
+type Markdown struct {
+	RawHTML RawHTMLMode
+	html    goldmark.Markdown
+}
+
+func NewMarkdown(mode RawHTMLMode) *Markdown {
+	var options []renderer.Option
+	switch mode {
+	case RawHTMLAllow:
+		options = append(options, goldmarkhtml.WithUnsafe())
+	case RawHTMLEscape:
+		// Registered ahead of the default HTML renderer, so ours wins
+		options = append(options, renderer.WithNodeRenderers(goldmarkutil.Prioritized(&escapedHTMLRenderer{}, 100)))
+	}
+	return &Markdown{
+		RawHTML: mode,
+		html:    goldmark.New(goldmark.WithRendererOptions(options...)),
+	}
+}
+
+var (
+	defaultMarkdown     *Markdown
+	defaultMarkdownOnce sync.Once
+)
+
+// markdown returns the renderer configured from the environment.
+func markdown() *Markdown {
+	defaultMarkdownOnce.Do(func() {
+		defaultMarkdown = NewMarkdown(RawHTMLModeFromEnv())
+	})
+	return defaultMarkdown
+}
+
+// Render returns the body as HTML and as plain text.
+func (m *Markdown) Render(body string) (string, string, error) {
+	source := []byte(body)
+	doc := m.html.Parser().Parse(text.NewReader(source))
+
+	htmlBuffer := new(bytes.Buffer)
+	if err := m.html.Renderer().Render(htmlBuffer, source, doc); err != nil {
+		return "", "", err
+	}
+	plain := &textRenderer{source: source, mode: m.RawHTML}
+	return htmlBuffer.String(), plain.blocks(doc), nil
+}
+
+// escapedHTMLRenderer renders raw HTML as visible text instead of markup.
+type escapedHTMLRenderer struct{}
+
+func (r *escapedHTMLRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(ast.KindHTMLBlock, r.renderHTMLBlock)
+	reg.Register(ast.KindRawHTML, r.renderRawHTML)
+}
+
+func (r *escapedHTMLRenderer) renderHTMLBlock(w goldmarkutil.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		_, _ = w.WriteString("<p>")
+		_, _ = w.WriteString(html.EscapeString(strings.TrimRight(htmlBlockSource(node.(*ast.HTMLBlock), source), "\n")))
+		_, _ = w.WriteString("</p>\n")
+	}
+	return ast.WalkContinue, nil
+}
+
+func (r *escapedHTMLRenderer) renderRawHTML(w goldmarkutil.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		_, _ = w.WriteString(html.EscapeString(rawHTMLSource(node.(*ast.RawHTML), source)))
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+func htmlBlockSource(n *ast.HTMLBlock, source []byte) string {
+	var b strings.Builder
+	lines := n.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		line := lines.At(i)
+		b.Write(line.Value(source))
+	}
+	if n.HasClosure() {
+		b.Write(n.ClosureLine.Value(source))
+	}
+	return b.String()
+}
+
+func rawHTMLSource(n *ast.RawHTML, source []byte) string {
+	var b strings.Builder
+	for i := 0; i < n.Segments.Len(); i++ {
+		segment := n.Segments.At(i)
+		b.Write(segment.Value(source))
+	}
+	return b.String()
+}
+
+// textRenderer writes a Markdown document back out as readable plain text:
+// paragraphs separated by blank lines, links followed by their address, and
+// lists and quotes keeping their markers.
+type textRenderer struct {
+	source []byte
+	mode   RawHTMLMode
+}
+
+func (t *textRenderer) blocks(parent ast.Node) string {
+	var parts []string
+	for n := parent.FirstChild(); n != nil; n = n.NextSibling() {
+		if part := t.block(n); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+func (t *textRenderer) block(n ast.Node) string {
+	switch n := n.(type) {
+	case *ast.Heading:
+		heading := t.inline(n)
+		underline := "-"
+		if n.Level == 1 {
+			underline = "="
+		}
+		return heading + "\n" + strings.Repeat(underline, len([]rune(heading)))
+	case *ast.Paragraph, *ast.TextBlock:
+		return t.inline(n)
+	case *ast.ThematicBreak:
+		return "----"
+	case *ast.CodeBlock, *ast.FencedCodeBlock:
+		var b strings.Builder
+		lines := n.Lines()
+		for i := 0; i < lines.Len(); i++ {
+			line := lines.At(i)
+			b.WriteString("    ")
+			b.Write(line.Value(t.source))
+		}
+		return strings.TrimRight(b.String(), "\n")
+	case *ast.Blockquote:
+		return prefixLines(t.blocks(n), "> ", "> ")
+	case *ast.List:
+		separator := "\n\n"
+		if n.IsTight {
+			separator = "\n"
+		}
+		var items []string
+		number := n.Start
+		for item := n.FirstChild(); item != nil; item = item.NextSibling() {
+			marker := "- "
+			if n.IsOrdered() {
+				marker = fmt.Sprintf("%d. ", number)
+				number++
+			}
+			items = append(items, prefixLines(t.blocks(item), marker, strings.Repeat(" ", len(marker))))
+		}
+		return strings.Join(items, separator)
+	case *ast.HTMLBlock:
+		if t.mode == RawHTMLEscape {
+			return strings.TrimRight(htmlBlockSource(n, t.source), "\n")
+		}
+		return ""
+	}
+	return t.blocks(n)
+}
+
+func (t *textRenderer) inline(parent ast.Node) string {
+	var b strings.Builder
+	for n := parent.FirstChild(); n != nil; n = n.NextSibling() {
+		switch n := n.(type) {
+		case *ast.Text:
+			value := n.Segment.Value(t.source)
+			if !n.IsRaw() {
+				value = goldmarkutil.UnescapePunctuations(goldmarkutil.ResolveEntityNames(goldmarkutil.ResolveNumericReferences(value)))
+			}
+			b.Write(value)
+			if n.HardLineBreak() || n.SoftLineBreak() {
+				b.WriteString("\n")
+			}
+		case *ast.String:
+			b.Write(n.Value)
+		case *ast.Link:
+			label, destination := t.inline(n), string(n.Destination)
+			if label == destination {
+				b.WriteString(destination)
+			} else {
+				b.WriteString(label + " (" + destination + ")")
+			}
+		case *ast.AutoLink:
+			b.Write(n.Label(t.source))
+		case *ast.RawHTML:
+			if t.mode == RawHTMLEscape {
+				b.WriteString(rawHTMLSource(n, t.source))
+			}
+		default:
+			b.WriteString(t.inline(n))
+		}
+	}
+	return b.String()
+}
+
+// prefixLines puts first in front of the first line and rest in front of the others.
+func prefixLines(s string, first string, rest string) string {
+	lines := strings.Split(s, "\n")
+	for i := range lines {
+		prefix := rest
+		if i == 0 {
+			prefix = first
+		}
+		if lines[i] == "" {
+			prefix = strings.TrimRight(prefix, " ")
+		}
+		lines[i] = prefix + lines[i]
+	}
+	return strings.Join(lines, "\n")
+}
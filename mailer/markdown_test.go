@@ -0,0 +1,83 @@
+package mailer
+
+import (
+	"strings"
+	"testing"
+)
+
+const markdownBody = `# Hello
+
+Read **the post** [here](https://example.com/post) & enjoy.
+
+- one
+- two
+
+<script>alert(1)</script>
+
+Inline <b>bold</b> text.`
+
+func TestMarkdownEscapesRawHTML(t *testing.T) {
+	html, text, err := NewMarkdown(RawHTMLEscape).Render(markdownBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"<h1>Hello</h1>",
+		`<a href="https://example.com/post">here</a>`,
+		"<li>one</li>",
+		"&lt;script&gt;alert(1)&lt;/script&gt;",
+		"Inline &lt;b&gt;bold&lt;/b&gt; text.",
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("HTML part is missing %q:\n%s", want, html)
+		}
+	}
+	if strings.Contains(html, "<script>") {
+		t.Errorf("HTML part kept the raw script tag:\n%s", html)
+	}
+
+	wantText := "Hello\n=====\n\nRead the post here (https://example.com/post) & enjoy.\n\n- one\n- two\n\n<script>alert(1)</script>\n\nInline <b>bold</b> text."
+	if text != wantText {
+		t.Errorf("got text part\n%s\nwant\n%s", text, wantText)
+	}
+}
+
+func TestMarkdownStripsRawHTML(t *testing.T) {
+	html, text, err := NewMarkdown(RawHTMLStrip).Render(markdownBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(html, "script") || strings.Contains(html, "<b>") {
+		t.Errorf("HTML part kept raw HTML:\n%s", html)
+	}
+	if strings.Contains(text, "script") || !strings.Contains(text, "Inline bold text.") {
+		t.Errorf("text part kept raw HTML:\n%s", text)
+	}
+}
+
+func TestBuildMessageIsMultipart(t *testing.T) {
+	message, err := buildMessage(Email{
+		From:            "from@example.com",
+		To:              "to@example.com",
+		Subject:         "Héllo",
+		Body:            "Some *news*",
+		UnsubscribeLink: "https://example.com/unsub",
+		WebLink:         "https://example.com/view/abc",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Content-Type: multipart/alternative; boundary=",
+		"Subject: =?utf-8?q?H=C3=A9llo?=",
+		"Content-Type: text/plain; charset=\"utf-8\"",
+		"Content-Type: text/html; charset=\"utf-8\"",
+		"<em>news</em>",
+		"https://example.com/unsub",
+		"https://example.com/view/abc",
+	} {
+		if !strings.Contains(message, want) {
+			t.Errorf("message is missing %q:\n%s", want, message)
+		}
+	}
+}
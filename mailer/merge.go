@@ -0,0 +1,253 @@
+package mailer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/keur/chillmailer/datastore"
+)
+
+// MergeData is what merge tags in a blast's subject and body can refer to,
+// such as {{.FirstName}}. Missing values can be given a default with
+// {{default "friend" .FirstName}}.
+type MergeData struct {
+	Email      string
+	FirstName  string
+	LastName   string
+	ListName   string
+	TimeJoined time.Time
+	// Fields holds the subscriber's custom fields, formatted as text
+	Fields map[string]string
+}
+
+// SampleMergeData stands in for a subscriber when checking merge tags. It has
+// a value for each of the list's custom fields, so that referring to any
+// other field is a mistake.
+func SampleMergeData(listName string, fields []datastore.ListField) MergeData {
+	sample := MergeData{
+		Email:      "subscriber@example.com",
+		FirstName:  "Ada",
+		LastName:   "Lovelace",
+		ListName:   listName,
+		TimeJoined: time.Now(),
+		Fields:     make(map[string]string),
+	}
+	for _, field := range fields {
+		sample.Fields[field.Name] = sampleFieldValue(field.Type)
+	}
+	return sample
+}
+
+// ListsFields gathers the custom fields of several lists, for checking the
+// merge tags of a blast going to all of them. Subscribers of a list without
+// one of the fields get an empty value for it.
+func ListsFields(ds datastore.Datastore, listIDs []int) ([]datastore.ListField, error) {
+	var fields []datastore.ListField
+	seen := make(map[string]bool)
+	for _, listID := range listIDs {
+		listFields, err := ds.QueryListFields(listID)
+		if err != nil {
+			return nil, err
+		}
+		for _, field := range listFields {
+			if !seen[field.Name] {
+				seen[field.Name] = true
+				fields = append(fields, field)
+			}
+		}
+	}
+	return fields, nil
+}
+
+// BlastsUsingField returns the pending blasts to a list whose merge tags need
+// one of its custom fields, and would no longer send if it were deleted.
+// Blasts also going to another list with a field of that name are fine.
+func BlastsUsingField(ds datastore.Datastore, listID int, name string) ([]datastore.Blast, error) {
+	blasts, err := ds.QueryListBlastsByStatus(listID, datastore.BlastScheduled, datastore.BlastPaused)
+	if err != nil {
+		return nil, err
+	}
+	listFields, err := ds.QueryListFields(listID)
+	if err != nil {
+		return nil, err
+	}
+	var remaining []datastore.ListField
+	for _, field := range listFields {
+		if field.Name != name {
+			remaining = append(remaining, field)
+		}
+	}
+
+	var using []datastore.Blast
+	for _, blast := range blasts {
+		lists, err := ds.QueryBlastLists(blast.ID)
+		if err != nil {
+			return nil, err
+		}
+		var otherListIDs []int
+		for _, list := range lists {
+			if list.ListID != listID {
+				otherListIDs = append(otherListIDs, list.ListID)
+			}
+		}
+		otherFields, err := ListsFields(ds, otherListIDs)
+		if err != nil {
+			return nil, err
+		}
+		// Blasts that are already broken aren't this field's fault
+		before := SampleMergeData(blast.ListName, append(listFields, otherFields...))
+		after := SampleMergeData(blast.ListName, append(remaining, otherFields...))
+		if _, err = ParseMergeTags(blast.Subject, blast.Body, before); err != nil {
+			continue
+		}
+		if _, err = ParseMergeTags(blast.Subject, blast.Body, after); err != nil {
+			using = append(using, blast)
+		}
+	}
+	return using, nil
+}
+
+func sampleFieldValue(fieldType datastore.FieldType) string {
+	switch fieldType {
+	case datastore.FieldNumber:
+		return "42"
+	case datastore.FieldDate:
+		return time.Now().Format(datastore.FieldDateLayout)
+	case datastore.FieldBool:
+		return "true"
+	}
+	return "sample"
+}
+
+var mergeFuncs = template.FuncMap{
+	"default": mergeDefault,
+}
+
+// mergeDefault returns value, or fallback when value is empty.
+func mergeDefault(fallback any, value any) any {
+	if value == nil {
+		return fallback
+	}
+	v := reflect.ValueOf(value)
+	if v.IsZero() || (v.Kind() == reflect.String && strings.TrimSpace(v.String()) == "") {
+		return fallback
+	}
+	return value
+}
+
+// MergeTemplate is a blast's subject and body, parsed once and then filled in
+// for each recipient.
+type MergeTemplate struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+// ParseMergeTags parses the merge tags in a subject and body, and tries them
+// out on sample data so that mistakes show up before anything is sent. The
+// sample must have every custom field, while real subscribers missing one get
+// an empty value.
+func ParseMergeTags(subject string, body string, sample MergeData) (*MergeTemplate, error) {
+	strict, err := parseMergeTemplate(subject, body, "missingkey=error")
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err = strict.Render(sample); err != nil {
+		return nil, err
+	}
+	return parseMergeTemplate(subject, body, "missingkey=zero")
+}
+
+func parseMergeTemplate(subject string, body string, option string) (*MergeTemplate, error) {
+	t := &MergeTemplate{}
+	var err error
+	if t.subject, err = template.New("subject").Funcs(mergeFuncs).Option(option).Parse(subject); err != nil {
+		return nil, mergeTagError("subject", err)
+	}
+	if t.body, err = template.New("body").Funcs(mergeFuncs).Option(option).Parse(body); err != nil {
+		return nil, mergeTagError("body", err)
+	}
+	return t, nil
+}
+
+func mergeTagError(part string, err error) error {
+	return errors.New(fmt.Sprintf("Invalid merge tag in %s: %s", part, err))
+}
+
+// Render fills in the merge tags for one recipient. Values are escaped in the
+// body, so whatever subscribers put in their name is shown as plain text
+// rather than read as Markdown or HTML.
+func (t *MergeTemplate) Render(data MergeData) (string, string, error) {
+	subject := new(bytes.Buffer)
+	if err := t.subject.Execute(subject, &data); err != nil {
+		return "", "", mergeTagError("subject", err)
+	}
+	body := new(bytes.Buffer)
+	escaped := data.escaped()
+	if err := t.body.Execute(body, &escaped); err != nil {
+		return "", "", mergeTagError("body", err)
+	}
+	return strings.TrimSpace(subject.String()), body.String(), nil
+}
+
+func (d MergeData) escaped() MergeData {
+	escaped := d
+	escaped.Email = escapeMarkdown(d.Email)
+	escaped.FirstName = escapeMarkdown(d.FirstName)
+	escaped.LastName = escapeMarkdown(d.LastName)
+	escaped.ListName = escapeMarkdown(d.ListName)
+	escaped.Fields = make(map[string]string, len(d.Fields))
+	for name, value := range d.Fields {
+		escaped.Fields[name] = escapeMarkdown(value)
+	}
+	return escaped
+}
+
+// escapeMarkdown backslash escapes every ASCII punctuation character, which
+// CommonMark then shows as is.
+func escapeMarkdown(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r < 128 && strings.ContainsRune("!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~", r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// RenderPublicCopy renders a blast's subject and body for the web. Merge tags
+// get nothing about any subscriber, so only their defaults show, and there is
+// none of the email layout, so no unsubscribe footer. Blasts that aren't valid
+// templates, such as ones from before merge tags with a literal {{, are shown
+// as written.
+func RenderPublicCopy(subject string, body string, listName string) (string, string, error) {
+	blank := MergeData{ListName: listName}
+	if t, err := parseMergeTemplate(subject, body, "missingkey=zero"); err == nil {
+		if renderedSubject, renderedBody, err := t.Render(blank); err == nil {
+			subject, body = renderedSubject, renderedBody
+		}
+	}
+	html, _, err := markdown().Render(body)
+	return subject, html, err
+}
+
+// SubscriberMergeData fills in merge tags for a subscriber of a list.
+func SubscriberMergeData(listName string, sub datastore.SubscriberInfo) MergeData {
+	data := MergeData{
+		Email:      sub.Email,
+		FirstName:  sub.FirstName,
+		LastName:   sub.LastName,
+		ListName:   listName,
+		TimeJoined: sub.TimeJoined,
+		Fields:     make(map[string]string, len(sub.Fields)),
+	}
+	for name := range sub.Fields {
+		data.Fields[name] = sub.Fields.Format(name)
+	}
+	return data
+}
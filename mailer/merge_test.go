@@ -0,0 +1,98 @@
+package mailer
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keur/chillmailer/datastore"
+)
+
+func TestMergeTagsRenderPerRecipient(t *testing.T) {
+	merge, err := ParseMergeTags(
+		`Hi {{default "friend" .FirstName}}`,
+		"Hello {{default \"friend\" .FirstName}} ({{.Email}}), on {{.ListName}} since {{.TimeJoined.Format \"2006\"}}. Plan: {{default \"free\" .Fields.plan}}",
+		SampleMergeData("Blog", []datastore.ListField{{Name: "plan", Type: datastore.FieldString}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subject, body, err := merge.Render(MergeData{Email: "ada@example.com", FirstName: "Ada", ListName: "Blog", TimeJoined: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "Hi Ada" {
+		t.Errorf("got subject %q", subject)
+	}
+	if body != `Hello Ada (ada\@example\.com), on Blog since 2021. Plan: free` {
+		t.Errorf("got body %q", body)
+	}
+
+	subject, _, err = merge.Render(MergeData{Email: "anon@example.com", FirstName: "  "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "Hi friend" {
+		t.Errorf("got subject %q, want the default", subject)
+	}
+}
+
+func TestMergeTagsEscapeSubscriberValues(t *testing.T) {
+	merge, err := ParseMergeTags("Hi", "Hello {{.FirstName}}", SampleMergeData("Blog", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, body, err := merge.Render(MergeData{FirstName: "<script>alert(1)</script> **bold**"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	html, text, err := NewMarkdown(RawHTMLAllow).Render(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(html, "<script>") || strings.Contains(html, "<strong>") {
+		t.Errorf("subscriber value was read as markup:\n%s", html)
+	}
+	if text != "Hello <script>alert(1)</script> **bold**" {
+		t.Errorf("got text %q", text)
+	}
+}
+
+func TestBadMergeTagsAreCaughtWhenParsing(t *testing.T) {
+	for _, tc := range []struct {
+		subject string
+		body    string
+		err     string
+	}{
+		{subject: "Hi {{.FirstName", body: "Hello", err: "Invalid merge tag in subject"},
+		{subject: "Hi", body: "Hello {{.Nickname}}", err: "Invalid merge tag in body"},
+		{subject: "Hi", body: "Hello {{nope .FirstName}}", err: "Invalid merge tag in body"},
+		{subject: "Hi", body: "Your plan: {{.Fields.plna}}", err: "Invalid merge tag in body"},
+	} {
+		_, err := ParseMergeTags(tc.subject, tc.body, SampleMergeData("Blog", nil))
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("ParseMergeTags(%q, %q) = %v, want error containing %q", tc.subject, tc.body, err, tc.err)
+		}
+	}
+}
+
+func TestPublicCopyLeavesOutSubscriberData(t *testing.T) {
+	subject, html, err := RenderPublicCopy(`Hi {{default "friend" .FirstName}}`, "Sent to {{.Email}} on {{.ListName}}", "Blog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "Hi friend" || html != "<p>Sent to  on Blog</p>\n" {
+		t.Errorf("got subject %q and HTML %q", subject, html)
+	}
+}
+
+func TestPublicCopyShowsBrokenTemplatesAsWritten(t *testing.T) {
+	subject, html, err := RenderPublicCopy("Braces {{ in the subject", "Type {{ to start a tag", "Blog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "Braces {{ in the subject" || html != "<p>Type {{ to start a tag</p>\n" {
+		t.Errorf("got subject %q and HTML %q", subject, html)
+	}
+}
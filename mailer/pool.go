@@ -0,0 +1,80 @@
+package mailer
+
+import (
+	"net/smtp"
+)
+
+// ConnPool keeps authenticated SMTP sessions open between messages, so parallel
+// workers don't pay for a TLS handshake and login on every recipient.
+type ConnPool struct {
+	transport *Transport
+	idle      chan *smtp.Client
+}
+
+func NewConnPool(transport *Transport, size int) *ConnPool {
+	if size < 1 {
+		size = 1
+	}
+	return &ConnPool{transport: transport, idle: make(chan *smtp.Client, size)}
+}
+
+func (p *ConnPool) SendMail(email Email) error {
+	message, err := buildMessage(email)
+	if err != nil {
+		return err
+	}
+	c, err := p.get()
+	if err != nil {
+		return err
+	}
+	if err = sendMessage(c, email.From, email.To, message); err != nil {
+		// The session may be in any state after a failure, so start fresh next time
+		c.Close()
+		return err
+	}
+	p.put(c)
+	return nil
+}
+
+// get hands out an idle session if one is still alive, or opens a new one.
+func (p *ConnPool) get() (*smtp.Client, error) {
+	for {
+		select {
+		case c := <-p.idle:
+			if c.Noop() == nil {
+				return c, nil
+			}
+			c.Close()
+		default:
+			return p.transport.connect()
+		}
+	}
+}
+
+func (p *ConnPool) put(c *smtp.Client) {
+	if c.Reset() != nil {
+		c.Close()
+		return
+	}
+	select {
+	case p.idle <- c:
+	default:
+		if c.Quit() != nil {
+			c.Close()
+		}
+	}
+}
+
+// Close ends every idle session.
+func (p *ConnPool) Close() {
+	for {
+		select {
+		case c := <-p.idle:
+			if c.Quit() != nil {
+				c.Close()
+			}
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package mailer
+
+import "testing"
+
+func TestPoolReusesConnections(t *testing.T) {
+	s := newFakeSMTPServer(t, nil)
+	pool := NewConnPool(s.transport(), 1)
+	defer pool.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := pool.SendMail(testEmail); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if s.connections() != 1 {
+		t.Fatalf("expected 1 connection, got %d", s.connections())
+	}
+}
+
+func TestPoolDropsConnectionAfterFailure(t *testing.T) {
+	s := newFakeSMTPServer(t, func(conn int, cmd string) string {
+		if cmd == "RCPT" && conn == 1 {
+			return "550 no such user"
+		}
+		return ""
+	})
+	pool := NewConnPool(s.transport(), 1)
+	defer pool.Close()
+
+	if err := pool.SendMail(testEmail); err == nil {
+		t.Fatal("expected an error")
+	}
+	if err := pool.SendMail(testEmail); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.connections() != 2 {
+		t.Fatalf("expected 2 connections, got %d", s.connections())
+	}
+}
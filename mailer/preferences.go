@@ -0,0 +1,71 @@
+package mailer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"path/filepath"
+	"strings"
+
+	"github.com/keur/chillmailer/datastore"
+	"github.com/keur/chillmailer/util"
+)
+
+// PreferenceSigner signs the links subscribers use to manage their
+// subscriptions, so nobody can open the preference center for an address
+// without having been sent mail there.
+type PreferenceSigner struct {
+	secret []byte
+}
+
+func NewPreferenceSigner(secret string) *PreferenceSigner {
+	return &PreferenceSigner{secret: []byte(secret)}
+}
+
+// PreferenceSignerFromEnv signs with PREFERENCES_SECRET, or else a secret
+// generated and kept in the database. Changing it breaks every link already sent.
+func PreferenceSignerFromEnv(ds datastore.Datastore) (*PreferenceSigner, error) {
+	secret := util.GetenvOr("PREFERENCES_SECRET", "")
+	if secret == "" {
+		var err error
+		if secret, err = ds.LoadSecret("preferences"); err != nil {
+			return nil, err
+		}
+	}
+	return NewPreferenceSigner(secret), nil
+}
+
+func (p *PreferenceSigner) sign(email string) []byte {
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write([]byte(util.NormalizeEmail(email)))
+	return mac.Sum(nil)
+}
+
+// Token is the address along with its signature.
+func (p *PreferenceSigner) Token(email string) string {
+	encoding := base64.RawURLEncoding
+	return encoding.EncodeToString([]byte(email)) + "." + encoding.EncodeToString(p.sign(email))
+}
+
+// Verify returns the address a token was made for, if its signature holds up.
+func (p *PreferenceSigner) Verify(token string) (string, bool) {
+	encoding := base64.RawURLEncoding
+	rawEmail, rawSignature, found := strings.Cut(token, ".")
+	if !found {
+		return "", false
+	}
+	email, err := encoding.DecodeString(rawEmail)
+	if err != nil {
+		return "", false
+	}
+	signature, err := encoding.DecodeString(rawSignature)
+	if err != nil || !hmac.Equal(signature, p.sign(string(email))) {
+		return "", false
+	}
+	return string(email), true
+}
+
+// Link is where the address can manage all its subscriptions.
+func (p *PreferenceSigner) Link(webRoot string, email string) string {
+	return webRoot + filepath.Join("/preferences", p.Token(email))
+}
@@ -0,0 +1,31 @@
+package mailer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPreferenceTokensVerify(t *testing.T) {
+	signer := NewPreferenceSigner("secret")
+	token := signer.Token("Ada@Example.com")
+
+	email, ok := signer.Verify(token)
+	if !ok || email != "Ada@Example.com" {
+		t.Fatalf("got %q, %v for a token we signed", email, ok)
+	}
+	if _, ok = NewPreferenceSigner("other").Verify(token); ok {
+		t.Error("a token signed with another secret was accepted")
+	}
+
+	forged := NewPreferenceSigner("secret").Token("eve@example.com")
+	rawEmail, _, _ := strings.Cut(forged, ".")
+	_, signature, _ := strings.Cut(token, ".")
+	if _, ok = signer.Verify(rawEmail + "." + signature); ok {
+		t.Error("a signature was accepted for another address")
+	}
+	for _, bad := range []string{"", ".", "no-dot", "!!.!!"} {
+		if _, ok = signer.Verify(bad); ok {
+			t.Errorf("malformed token %q was accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package mailer
+
+import (
+	"sync"
+	"time"
+)
+
+type ProgressEventType string
+
+const (
+	ProgressQueued    ProgressEventType = "queued"
+	ProgressStarted   ProgressEventType = "started"
+	ProgressSent      ProgressEventType = "sent"
+	ProgressFailed    ProgressEventType = "failed"
+	ProgressPaused    ProgressEventType = "paused"
+	ProgressCancelled ProgressEventType = "cancelled"
+	ProgressFinished  ProgressEventType = "finished"
+)
+
+// ProgressEvent reports something that happened to a blast. The counts are a
+// running tally for the whole blast, so a listener never needs to add them up.
+type ProgressEvent struct {
+	BlastID  int               `json:"blast_id"`
+	ListName string            `json:"list_name"`
+	Type     ProgressEventType `json:"type"`
+	Email    string            `json:"email,omitempty"`
+	Error    string            `json:"error,omitempty"`
+	Sent     int               `json:"sent"`
+	Failed   int               `json:"failed"`
+	Total    int               `json:"total"`
+	Time     time.Time         `json:"time"`
+}
+
+// ProgressHub fans blast progress events out to any number of listeners.
+type ProgressHub struct {
+	Mutex       *sync.Mutex
+	Subscribers map[chan ProgressEvent]struct{}
+}
+
+func NewProgressHub() *ProgressHub {
+	return &ProgressHub{Mutex: &sync.Mutex{}, Subscribers: make(map[chan ProgressEvent]struct{})}
+}
+
+// Subscribe returns a channel of events and a function to stop listening.
+func (h *ProgressHub) Subscribe() (<-chan ProgressEvent, func()) {
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+
+	ch := make(chan ProgressEvent, 64)
+	h.Subscribers[ch] = struct{}{}
+	return ch, func() {
+		h.Mutex.Lock()
+		defer h.Mutex.Unlock()
+
+		if _, ok := h.Subscribers[ch]; ok {
+			delete(h.Subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Publish never blocks the sender. A listener that falls too far behind misses
+// events, which is fine since every event carries the full tally.
+func (h *ProgressHub) Publish(event ProgressEvent) {
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	for ch := range h.Subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package mailer
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/keur/chillmailer/util"
+
+	"github.com/rs/zerolog/log"
+)
+
+// SendConfig describes what our SMTP relay lets us get away with.
+type SendConfig struct {
+	// Rate is the number of messages per second, with bursts of up to Burst
+	Rate  float64
+	Burst int
+	// DailyQuota caps messages per UTC day. Zero means no cap.
+	DailyQuota int
+	// Workers is how many messages may be in flight at once
+	Workers int
+	// Warmup optionally caps daily volume further while a new sender warms up
+	Warmup *WarmupPlan
+	// DomainLimits throttles individual recipient domains, see ParseDomainLimits
+	DomainLimits map[string]DomainLimit
+}
+
+// SendConfigFromEnv defaults to AWS SES sandbox limits of 1 email per second.
+func SendConfigFromEnv() SendConfig {
+	config := SendConfig{
+		Rate:       util.GetenvFloatOr("SMTP_RATE", 1),
+		Burst:      util.GetenvIntOr("SMTP_BURST", 1),
+		DailyQuota: util.GetenvIntOr("SMTP_DAILY_QUOTA", 0),
+		Workers:    util.GetenvIntOr("SMTP_WORKERS", 1),
+	}
+	// A limiter with no rate lets only the first message through
+	if config.Rate <= 0 {
+		log.Error().Msgf("Ignoring invalid SMTP_RATE %g, sending 1 email per second", config.Rate)
+		config.Rate = 1
+	}
+	if config.Burst < 1 {
+		config.Burst = 1
+	}
+	if config.Workers < 1 {
+		config.Workers = 1
+	}
+
+	if spec := os.Getenv("SMTP_DOMAIN_LIMITS"); spec != "" {
+		limits, err := ParseDomainLimits(spec)
+		if err != nil {
+			log.Error().Err(err).Msg("Ignoring invalid domain limits")
+		} else {
+			config.DomainLimits = limits
+		}
+	}
+
+	if schedule := os.Getenv("SMTP_WARMUP_SCHEDULE"); schedule != "" {
+		start := os.Getenv("SMTP_WARMUP_START")
+		if start == "" {
+			start = time.Now().UTC().Format("2006-01-02")
+			log.Warn().Msgf("SMTP_WARMUP_START not set, warming up from today (%s)", start)
+		}
+		plan, err := ParseWarmupPlan(schedule, start)
+		if err != nil {
+			log.Error().Err(err).Msg("Ignoring invalid warm-up plan")
+		} else {
+			config.Warmup = plan
+		}
+	}
+	return config
+}
+
+// DailyQuota hands out a limited number of sends per UTC day. Once a day's
+// sends are used up, Take blocks until the next day starts.
+type DailyQuota struct {
+	Mutex *sync.Mutex
+	// Limit returns the cap for a given day, where zero means no cap
+	Limit func(day time.Time) int
+	// Used counts sends already made since the start of a day, for when the
+	// quota is first consulted on that day (after a restart, say)
+	Used func(since time.Time) (int, error)
+
+	day  time.Time
+	used int
+}
+
+func startOfDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// Take reserves one send, waiting for tomorrow if today's quota is used up.
+func (q *DailyQuota) Take(ctx context.Context) error {
+	for {
+		wait, err := q.tryTake()
+		if err != nil {
+			return err
+		}
+		if wait == 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// tryTake reserves a send if there is one left today, or otherwise returns how
+// long until there is.
+func (q *DailyQuota) tryTake() (time.Duration, error) {
+	q.Mutex.Lock()
+	defer q.Mutex.Unlock()
+
+	now := time.Now()
+	today := startOfDay(now)
+	if err := q.refresh(today); err != nil {
+		return 0, err
+	}
+
+	limit := q.Limit(today)
+	if limit > 0 && q.used >= limit {
+		return today.Add(24 * time.Hour).Sub(now), nil
+	}
+	q.used++
+	return 0, nil
+}
+
+// refresh starts counting afresh when the day rolls over. The caller holds the mutex.
+func (q *DailyQuota) refresh(today time.Time) error {
+	if q.day.Equal(today) {
+		return nil
+	}
+	used, err := q.Used(today)
+	if err != nil {
+		return err
+	}
+	q.day, q.used = today, used
+	return nil
+}
+
+// Release gives back a send that was taken but not used.
+func (q *DailyQuota) Release() {
+	q.Mutex.Lock()
+	defer q.Mutex.Unlock()
+
+	if q.used > 0 {
+		q.used--
+	}
+}
+
+// Remaining reports how many sends are left today, or -1 when there is no cap.
+func (q *DailyQuota) Remaining() (int, error) {
+	q.Mutex.Lock()
+	defer q.Mutex.Unlock()
+
+	today := startOfDay(time.Now())
+	if err := q.refresh(today); err != nil {
+		return 0, err
+	}
+	limit := q.Limit(today)
+	if limit <= 0 {
+		return -1, nil
+	}
+	if q.used >= limit {
+		return 0, nil
+	}
+	return limit - q.used, nil
+}
@@ -0,0 +1,35 @@
+package mailer
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDailyQuotaBlocksWhenUsedUp(t *testing.T) {
+	quota := &DailyQuota{
+		Mutex: &sync.Mutex{},
+		Limit: func(time.Time) int { return 3 },
+		Used:  func(time.Time) (int, error) { return 1, nil },
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	for i := 0; i < 2; i++ {
+		if err := quota.Take(ctx); err != nil {
+			t.Fatalf("take %d: unexpected error: %v", i, err)
+		}
+	}
+	if remaining, _ := quota.Remaining(); remaining != 0 {
+		t.Fatalf("expected no sends left, got %d", remaining)
+	}
+	if err := quota.Take(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected to wait for tomorrow, got %v", err)
+	}
+
+	quota.Release()
+	if remaining, _ := quota.Remaining(); remaining != 1 {
+		t.Fatalf("expected 1 send left after release, got %d", remaining)
+	}
+}
@@ -0,0 +1,110 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/textproto"
+	"syscall"
+	"time"
+
+	"github.com/keur/chillmailer/util"
+)
+
+// RetryPolicy controls how often and how patiently we retry transient send failures.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+func RetryPolicyFromEnv() RetryPolicy {
+	policy := RetryPolicy{
+		MaxAttempts: util.GetenvIntOr("SMTP_MAX_ATTEMPTS", 5),
+		BaseDelay:   util.GetenvDurationOr("SMTP_RETRY_BASE_DELAY", 2*time.Second),
+		MaxDelay:    util.GetenvDurationOr("SMTP_RETRY_MAX_DELAY", 5*time.Minute),
+	}
+	if policy.MaxAttempts < 1 {
+		policy.MaxAttempts = 1
+	}
+	return policy
+}
+
+// Backoff returns how long to wait after the given (1-indexed) failed attempt.
+// The delay doubles every attempt up to MaxDelay, and is jittered down to as
+// little as half of that so many failing sends don't retry in lockstep.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	half := int64(delay / 2)
+	if half <= 0 {
+		return delay
+	}
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// GiveUpError is returned once a transient failure has used up every attempt.
+type GiveUpError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *GiveUpError) Error() string {
+	return fmt.Sprintf("gave up after %d attempts: %s", e.Attempts, e.Err)
+}
+
+func (e *GiveUpError) Unwrap() error {
+	return e.Err
+}
+
+// IsTransientError reports whether a failed send is worth retrying. SMTP 4xx
+// replies are temporary by definition, and so are network failures like resets
+// and timeouts. Everything else, including 5xx replies, is permanent.
+func IsTransientError(err error) bool {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code >= 400 && protoErr.Code < 500
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// SendWithRetry calls send until it succeeds, fails permanently, or runs out of
+// attempts. It returns the number of attempts made alongside the final error.
+func SendWithRetry(ctx context.Context, policy RetryPolicy, send func() error) (int, error) {
+	attempt := 0
+	for {
+		attempt++
+		err := send()
+		if err == nil {
+			return attempt, nil
+		}
+		if !IsTransientError(err) {
+			return attempt, err
+		}
+		if attempt >= policy.MaxAttempts {
+			return attempt, &GiveUpError{Attempts: attempt, Err: err}
+		}
+
+		select {
+		case <-time.After(policy.Backoff(attempt)):
+		case <-ctx.Done():
+			return attempt, &GiveUpError{Attempts: attempt, Err: err}
+		}
+	}
+}
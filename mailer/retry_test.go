@@ -0,0 +1,258 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// Templates are resolved relative to the working directory
+	if err := os.Chdir(".."); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// fakeSMTPServer speaks just enough SMTP for our client. replies maps an
+// upper case command (MAIL, RCPT, DATA, or "." for the end of the message) to
+// the reply it should get on a given connection. Returning "" uses the default.
+type fakeSMTPServer struct {
+	listener net.Listener
+	replies  func(conn int, cmd string) string
+	// hangup makes the server drop the given connection before greeting
+	hangup func(conn int) bool
+
+	mutex sync.Mutex
+	conns int
+}
+
+func newFakeSMTPServer(t *testing.T, replies func(conn int, cmd string) string) *fakeSMTPServer {
+	return newHangingUpSMTPServer(t, replies, nil)
+}
+
+// newHangingUpSMTPServer is a fake server that drops the connections hangup picks.
+func newHangingUpSMTPServer(t *testing.T, replies func(conn int, cmd string) string, hangup func(conn int) bool) *fakeSMTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTPServer{listener: listener, replies: replies, hangup: hangup}
+	t.Cleanup(func() { listener.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *fakeSMTPServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		s.conns++
+		n := s.conns
+		s.mutex.Unlock()
+		go s.handle(conn, n)
+	}
+}
+
+func (s *fakeSMTPServer) connections() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.conns
+}
+
+func (s *fakeSMTPServer) handle(conn net.Conn, n int) {
+	defer conn.Close()
+	if s.hangup != nil && s.hangup(n) {
+		return
+	}
+
+	r := bufio.NewReader(conn)
+	reply := func(cmd string, fallback string) {
+		msg := fallback
+		if s.replies != nil {
+			if custom := s.replies(n, cmd); custom != "" {
+				msg = custom
+			}
+		}
+		conn.Write([]byte(msg + "\r\n"))
+	}
+
+	conn.Write([]byte("220 localhost fake\r\n"))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.Fields(line + " x")[0])
+		switch cmd {
+		case "EHLO", "HELO":
+			conn.Write([]byte("250-localhost\r\n250 AUTH PLAIN\r\n"))
+		case "AUTH":
+			reply(cmd, "235 ok")
+		case "MAIL", "RCPT":
+			reply(cmd, "250 ok")
+		case "DATA":
+			reply(cmd, "354 go ahead")
+			for {
+				data, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if data == ".\r\n" {
+					break
+				}
+			}
+			reply(".", "250 queued")
+		case "QUIT":
+			conn.Write([]byte("221 bye\r\n"))
+			return
+		default:
+			conn.Write([]byte("250 ok\r\n"))
+		}
+	}
+}
+
+func (s *fakeSMTPServer) transport() *Transport {
+	return &Transport{
+		Host: "localhost",
+		Port: "25",
+		Auth: smtp.PlainAuth("", "user", "pass", "localhost"),
+		Dial: func(string) (net.Conn, error) {
+			return net.Dial("tcp", s.listener.Addr().String())
+		},
+	}
+}
+
+var testEmail = Email{
+	From:            "list@example.com",
+	To:              "sub@example.com",
+	Subject:         "Hi",
+	Body:            "Hello",
+	UnsubscribeLink: "http://localhost/unsubscribe",
+}
+
+var testPolicy = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+
+func sendTestMail(s *fakeSMTPServer) (int, error) {
+	transport := s.transport()
+	return SendWithRetry(context.Background(), testPolicy, func() error {
+		return transport.SendMail(testEmail)
+	})
+}
+
+func TestSendSucceeds(t *testing.T) {
+	s := newFakeSMTPServer(t, nil)
+	attempts, err := sendTestMail(s)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if attempts != 1 {
+		t.Fatalf("expected 1 attempt, got %d", attempts)
+	}
+}
+
+func TestPermanentFailureIsNotRetried(t *testing.T) {
+	s := newFakeSMTPServer(t, func(conn int, cmd string) string {
+		if cmd == "RCPT" {
+			return "550 no such user"
+		}
+		return ""
+	})
+	attempts, err := sendTestMail(s)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if IsTransientError(err) {
+		t.Fatalf("550 should be permanent: %v", err)
+	}
+	var giveUp *GiveUpError
+	if errors.As(err, &giveUp) {
+		t.Fatalf("permanent failures should not be reported as give ups: %v", err)
+	}
+	if attempts != 1 || s.connections() != 1 {
+		t.Fatalf("expected a single attempt, got %d attempts over %d connections", attempts, s.connections())
+	}
+}
+
+func TestTransientFailureIsRetried(t *testing.T) {
+	s := newFakeSMTPServer(t, func(conn int, cmd string) string {
+		if cmd == "RCPT" && conn < 3 {
+			return "451 try again later"
+		}
+		return ""
+	})
+	attempts, err := sendTestMail(s)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestTransientDataRejectionIsRetried(t *testing.T) {
+	s := newFakeSMTPServer(t, func(conn int, cmd string) string {
+		if cmd == "." && conn == 1 {
+			return "452 insufficient storage"
+		}
+		return ""
+	})
+	attempts, err := sendTestMail(s)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if attempts != 2 {
+		t.Fatalf("expected 2 attempts, got %d", attempts)
+	}
+}
+
+func TestConnectionResetIsRetried(t *testing.T) {
+	s := newHangingUpSMTPServer(t, nil, func(conn int) bool { return conn == 1 })
+	attempts, err := sendTestMail(s)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if attempts != 2 {
+		t.Fatalf("expected 2 attempts, got %d", attempts)
+	}
+}
+
+func TestGiveUpAfterMaxAttempts(t *testing.T) {
+	s := newFakeSMTPServer(t, func(conn int, cmd string) string {
+		if cmd == "MAIL" {
+			return "421 service not available"
+		}
+		return ""
+	})
+	attempts, err := sendTestMail(s)
+	var giveUp *GiveUpError
+	if !errors.As(err, &giveUp) {
+		t.Fatalf("expected a give up error, got %v", err)
+	}
+	if attempts != testPolicy.MaxAttempts || giveUp.Attempts != testPolicy.MaxAttempts {
+		t.Fatalf("expected %d attempts, got %d", testPolicy.MaxAttempts, attempts)
+	}
+	if s.connections() != testPolicy.MaxAttempts {
+		t.Fatalf("expected %d connections, got %d", testPolicy.MaxAttempts, s.connections())
+	}
+}
+
+func TestBackoffIsBounded(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 10, BaseDelay: time.Second, MaxDelay: 8 * time.Second}
+	for attempt := 1; attempt <= 10; attempt++ {
+		d := policy.Backoff(attempt)
+		if d > policy.MaxDelay || d < policy.BaseDelay/2 {
+			t.Fatalf("attempt %d backoff %v out of range", attempt, d)
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/keur/chillmailer/datastore"
+	"github.com/keur/chillmailer/util"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/time/rate"
+)
+
+// Scheduler sends stored blasts once their send time arrives. Every scheduled
+// blast gets a goroutine that sleeps until then, so the database is the source
+// of truth and Start picks everything back up after a restart.
+type Scheduler struct {
+	ds          datastore.Datastore
+	logger      *zerolog.Logger
+	canceller   *MailCanceller
+	retryPolicy RetryPolicy
+	progress    *ProgressHub
+	preferences *PreferenceSigner
+	// gracePeriod is how long a blast waits before sending, for lists without their own
+	gracePeriod time.Duration
+
+	// Sending is throttled across all blasts at once
+	config   SendConfig
+	limiter  *rate.Limiter
+	quota    *DailyQuota
+	throttle *DomainThrottle
+	workers  chan struct{}
+
+	poolMutex *sync.Mutex
+	pool      *ConnPool
+}
+
+func NewScheduler(logger *zerolog.Logger, ds datastore.Datastore, mc *MailCanceller, config SendConfig, retryPolicy RetryPolicy, progress *ProgressHub, preferences *PreferenceSigner) *Scheduler {
+	quota := &DailyQuota{
+		Mutex: &sync.Mutex{},
+		Limit: config.DailyLimit,
+		Used: func(since time.Time) (int, error) {
+			return ds.CountDeliveriesSince(datastore.DeliverySent, since)
+		},
+	}
+	return &Scheduler{
+		ds:          ds,
+		logger:      logger,
+		canceller:   mc,
+		retryPolicy: retryPolicy,
+		progress:    progress,
+		preferences: preferences,
+		gracePeriod: util.GetenvDurationOr("BLAST_GRACE_PERIOD", 30*time.Second),
+		config:      config,
+		limiter:     rate.NewLimiter(rate.Limit(config.Rate), config.Burst),
+		quota:       quota,
+		throttle:    NewDomainThrottle(config.DomainLimits),
+		workers:     make(chan struct{}, config.Workers),
+		poolMutex:   &sync.Mutex{},
+	}
+}
+
+// GracePeriod returns how long blasts on a list can be cancelled before they go out.
+func (s *Scheduler) GracePeriod(listID int) (time.Duration, error) {
+	gracePeriod, ok, err := s.ds.GetListGracePeriod(listID)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return s.gracePeriod, nil
+	}
+	return gracePeriod, nil
+}
+
+// Start schedules every blast still waiting to be sent, and picks back up any
+// blast that was interrupted mid-send by a restart.
+func (s *Scheduler) Start() error {
+	if err := s.ds.ReleaseClaimedDeliveries(); err != nil {
+		return err
+	}
+	interrupted, err := s.ds.QueryBlastsByStatus(datastore.BlastSending)
+	if err != nil {
+		return err
+	}
+	for _, blast := range interrupted {
+		if _, err = s.ds.TransitionBlastStatus(blast.ID, datastore.BlastSending, datastore.BlastScheduled); err != nil {
+			return err
+		}
+		s.logger.Info().Msgf("Resuming interrupted blast %d", blast.ID)
+	}
+
+	blasts, err := s.ds.QueryBlastsByStatus(datastore.BlastScheduled)
+	if err != nil {
+		return err
+	}
+	for _, blast := range blasts {
+		s.Schedule(blast)
+	}
+	s.logger.Info().Msgf("Restored %d scheduled blasts", len(blasts))
+	return nil
+}
+
+// Schedule starts waiting for a blast's send time. Scheduling a blast again
+// replaces the previous waiter, since its context gets cancelled.
+func (s *Scheduler) Schedule(blast datastore.Blast) {
+	ctx := s.canceller.ContextForBlast(blast.ID)
+	go func() {
+		defer s.canceller.FinishBlast(blast.ID, ctx)
+
+		timer := time.NewTimer(time.Until(blast.SendAt))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			s.dispatch(ctx, blast.ID, blast.SendAt)
+		case <-ctx.Done():
+			s.logger.Debug().Msgf("Stopped waiting on blast %d", blast.ID)
+		}
+	}()
+}
+
+// Enqueue stores a new blast to the lists and schedules it. The first list is the blast's own.
+func (s *Scheduler) Enqueue(listIDs []int, segmentID int, subject string, body string, webRoot string, author string, sendAt time.Time) (int, error) {
+	blastID, err := s.ds.CreateBlast(listIDs, segmentID, subject, body, webRoot, author, sendAt)
+	if err != nil {
+		return 0, err
+	}
+	blast, err := s.ds.GetBlast(blastID)
+	if err != nil {
+		return 0, err
+	}
+	s.Schedule(blast)
+	s.publish(blastID, ProgressQueued)
+	return blastID, nil
+}
+
+// publish announces a change to a blast with its progress as stored.
+func (s *Scheduler) publish(blastID int, eventType ProgressEventType) {
+	s.publishError(blastID, eventType, "")
+}
+
+// publishError is publish for a change caused by an error.
+func (s *Scheduler) publishError(blastID int, eventType ProgressEventType, message string) {
+	blast, err := s.ds.GetBlast(blastID)
+	if err != nil {
+		s.logger.Error().Err(err).Msgf("Could not load blast %d", blastID)
+		return
+	}
+	progress, err := s.ds.QueryBlastProgress(blastID)
+	if err != nil {
+		s.logger.Error().Err(err).Msgf("Could not load progress of blast %d", blastID)
+		return
+	}
+	s.progress.Publish(ProgressEvent{
+		BlastID:  blastID,
+		ListName: blast.ListName,
+		Type:     eventType,
+		Error:    message,
+		Sent:     progress.Sent,
+		Failed:   progress.Failed,
+		Total:    progress.Total,
+	})
+}
+
+// Reschedule moves a pending blast to a new send time. Paused blasts keep the
+// new time but stay paused until resumed.
+func (s *Scheduler) Reschedule(blastID int, sendAt time.Time) error {
+	blast, err := s.ds.GetBlast(blastID)
+	if err != nil {
+		return err
+	}
+	if !IsPending(blast.Status) {
+		return ErrBlastNotPending
+	}
+	if err = s.ds.UpdateBlastSchedule(blastID, sendAt); err != nil {
+		return err
+	}
+	// Reload so the waiter compares against exactly what the database holds
+	if blast, err = s.ds.GetBlast(blastID); err != nil {
+		return err
+	}
+	if blast.Status == datastore.BlastScheduled {
+		s.Schedule(blast)
+	}
+	return nil
+}
+
+// SendNow skips whatever is left of a pending blast's wait.
+func (s *Scheduler) SendNow(blastID int) error {
+	blast, err := s.ds.GetBlast(blastID)
+	if err != nil {
+		return err
+	}
+	if blast.Status != datastore.BlastScheduled {
+		return ErrBlastNotPending
+	}
+	return s.Reschedule(blastID, time.Now())
+}
+
+var ErrBlastNotPending = errors.New("Blast is no longer pending")
+
+// IsPending reports whether a blast with the given status has yet to be sent.
+func IsPending(status datastore.BlastStatus) bool {
+	return status == datastore.BlastScheduled || status == datastore.BlastPaused
+}
+
+// transitionFromAny moves a blast to a new status from the first of the given
+// statuses it is found in.
+func (s *Scheduler) transitionFromAny(blastID int, to datastore.BlastStatus, from ...datastore.BlastStatus) error {
+	for _, status := range from {
+		ok, err := s.ds.TransitionBlastStatus(blastID, status, to)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+	return ErrBlastNotPending
+}
+
+// Cancel stops a blast for good, whether it is still waiting or already sending.
+// Recipients it hasn't got to are marked cancelled rather than left pending.
+func (s *Scheduler) Cancel(blastID int) error {
+	err := s.transitionFromAny(blastID, datastore.BlastCancelled, datastore.BlastScheduled, datastore.BlastPaused, datastore.BlastSending)
+	if err != nil {
+		return err
+	}
+	s.canceller.CancelBlast(blastID)
+	if err = s.ds.CancelPendingDeliveries(blastID); err != nil {
+		return err
+	}
+	// One still sending is archived again by dispatch once its workers are done
+	s.archiveAborted(blastID)
+	s.publish(blastID, ProgressCancelled)
+	return nil
+}
+
+// Pause holds a blast until it is resumed. A waiting blast stays put at its send
+// time, while a sending blast stops after the recipient it is working on.
+func (s *Scheduler) Pause(blastID int) error {
+	err := s.transitionFromAny(blastID, datastore.BlastPaused, datastore.BlastScheduled, datastore.BlastSending)
+	if err != nil {
+		return err
+	}
+	s.canceller.CancelBlast(blastID)
+	s.publish(blastID, ProgressPaused)
+	return nil
+}
+
+// Resume puts a paused blast back on schedule. If its send time went by while
+// it was paused it goes out right away, continuing after the last recipient
+// it got to.
+func (s *Scheduler) Resume(blastID int) error {
+	ok, err := s.ds.TransitionBlastStatus(blastID, datastore.BlastPaused, datastore.BlastScheduled)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrBlastNotPending
+	}
+	if err = s.ds.SetBlastError(blastID, ""); err != nil {
+		return err
+	}
+	blast, err := s.ds.GetBlast(blastID)
+	if err != nil {
+		return err
+	}
+	s.Schedule(blast)
+	s.publish(blastID, ProgressQueued)
+	return nil
+}
+
+// CancelList cancels every pending blast of a list. Blasts from other lists
+// that also go to it are left alone.
+func (s *Scheduler) CancelList(listID int) error {
+	blasts, err := s.ds.QueryOwnBlastsByStatus(listID, datastore.BlastScheduled, datastore.BlastPaused)
+	if err != nil {
+		return err
+	}
+	for _, blast := range blasts {
+		if err = s.Cancel(blast.ID); err != nil && err != ErrBlastNotPending {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Scheduler) dispatch(ctx context.Context, blastID int, sendAt time.Time) {
+	blast, err := s.ds.GetBlast(blastID)
+	if err != nil {
+		s.logger.Error().Err(err).Msgf("Could not load blast %d", blastID)
+		return
+	}
+	// Cancelled, paused, or rescheduled and now owned by another waiter
+	if blast.Status != datastore.BlastScheduled || !blast.SendAt.Equal(sendAt) {
+		return
+	}
+	claimed, err := s.ds.TransitionBlastStatus(blastID, datastore.BlastScheduled, datastore.BlastSending)
+	if err != nil {
+		s.logger.Error().Err(err).Msgf("Could not claim blast %d", blastID)
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	if err = s.send(ctx, blast); err != nil {
+		s.logger.Error().Err(err).Msgf("Blast %d stopped early", blastID)
+		s.pauseWithError(blastID, err)
+		return
+	}
+	// Paused or cancelled along the way. A resumed blast is finished by the run
+	// that picks it back up, which may already be sending.
+	if ctx.Err() != nil {
+		s.archiveAborted(blastID)
+		return
+	}
+
+	finished, err := s.ds.TransitionBlastStatus(blastID, datastore.BlastSending, datastore.BlastSent)
+	if err != nil {
+		s.logger.Error().Err(err).Msgf("Could not mark blast %d as sent", blastID)
+		return
+	}
+	if finished {
+		s.archive(blast)
+		s.publish(blastID, ProgressFinished)
+	}
+}
+
+// pauseWithError holds a blast that couldn't send, such as one with a broken
+// merge tag or no SMTP settings, so the admin can see why and resume it once
+// it is fixed.
+func (s *Scheduler) pauseWithError(blastID int, sendErr error) {
+	// Recorded first, so the blast is never seen paused without a reason
+	if err := s.ds.SetBlastError(blastID, sendErr.Error()); err != nil {
+		s.logger.Error().Err(err).Msgf("Could not record why blast %d stopped", blastID)
+	}
+	paused, err := s.ds.TransitionBlastStatus(blastID, datastore.BlastSending, datastore.BlastPaused)
+	if err != nil {
+		s.logger.Error().Err(err).Msgf("Could not pause blast %d", blastID)
+		return
+	}
+	if !paused {
+		return
+	}
+	s.publishError(blastID, ProgressPaused, sendErr.Error())
+}
+
+// archiveAborted archives a blast cancelled partway through, if it reached anyone.
+func (s *Scheduler) archiveAborted(blastID int) {
+	blast, err := s.ds.GetBlast(blastID)
+	if err != nil {
+		s.logger.Error().Err(err).Msgf("Could not load blast %d", blastID)
+		return
+	}
+	if blast.Status != datastore.BlastCancelled {
+		return
+	}
+	progress, err := s.ds.QueryBlastProgress(blastID)
+	if err != nil {
+		s.logger.Error().Err(err).Msgf("Could not load progress of blast %d", blastID)
+		return
+	}
+	if progress.Sent > 0 {
+		s.archive(blast)
+	}
+}
+
+// archive keeps the rendered body and recipient count of a finished blast.
+func (s *Scheduler) archive(blast datastore.Blast) {
+	_, html, err := RenderPublicCopy(blast.Subject, blast.Body, blast.ListName)
+	if err != nil {
+		s.logger.Error().Err(err).Msgf("Could not render blast %d for the archive", blast.ID)
+	}
+	progress, err := s.ds.QueryBlastProgress(blast.ID)
+	if err != nil {
+		s.logger.Error().Err(err).Msgf("Could not load progress of blast %d", blast.ID)
+	}
+	if err = s.ds.ArchiveBlast(blast.ID, html, progress.Sent, time.Now()); err != nil {
+		s.logger.Error().Err(err).Msgf("Could not archive blast %d", blast.ID)
+	}
+}
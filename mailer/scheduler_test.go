@@ -0,0 +1,138 @@
+package mailer
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/keur/chillmailer/datastore"
+
+	"github.com/rs/zerolog"
+)
+
+// newTestScheduler sends through the fake server, with a list of the given subscribers.
+func newTestScheduler(t *testing.T, server *fakeSMTPServer, emails ...string) (*Scheduler, *datastore.Sqlite, int) {
+	t.Setenv("MX_DOMAIN", "example.com")
+	ds, err := datastore.NewSqlite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ds.Close() })
+	if err = ds.InitializeDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	listID, err := ds.CreateMailingList("Blog", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, email := range emails {
+		if err = ds.SubscribeToMailingList(listID, email, "", "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	logger := zerolog.Nop()
+	config := SendConfig{Rate: 1000, Burst: 1, Workers: 1}
+	s := NewScheduler(&logger, ds, NewMailCanceller(), config, testPolicy, NewProgressHub(), NewPreferenceSigner("secret"))
+	s.pool = NewConnPool(server.transport(), config.Workers)
+	t.Cleanup(func() { s.pool.Close() })
+	return s, ds, listID
+}
+
+// waitForEvent waits for the blast to publish an event of the type, and
+// returns the blast as stored by then.
+func waitForEvent(t *testing.T, s *Scheduler, events <-chan ProgressEvent, blastID int, eventType ProgressEventType) datastore.Blast {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event.BlastID != blastID || event.Type != eventType {
+				continue
+			}
+			blast, err := s.ds.GetBlast(blastID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return blast
+		case <-timeout:
+			t.Fatalf("blast %d never got a %s event", blastID, eventType)
+		}
+	}
+}
+
+func TestPauseAndResumeWhileSending(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var mutex sync.Mutex
+	messages := 0
+	server := newFakeSMTPServer(t, func(conn int, cmd string) string {
+		if cmd != "." {
+			return ""
+		}
+		mutex.Lock()
+		messages++
+		first := messages == 1
+		mutex.Unlock()
+		// Hold the first message in flight until the blast has been paused and resumed
+		if first {
+			close(started)
+			<-release
+		}
+		return ""
+	})
+	s, ds, listID := newTestScheduler(t, server, "a@example.com", "b@example.com", "c@example.com")
+	events, stop := s.progress.Subscribe()
+	defer stop()
+
+	blastID, err := s.Enqueue([]int{listID}, 0, "Hi", "Hello", "http://localhost", "admin", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	if err = s.Pause(blastID); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Resume(blastID); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+
+	blast := waitForEvent(t, s, events, blastID, ProgressFinished)
+	progress, err := ds.QueryBlastProgress(blastID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if messages != 3 || progress.Sent != 3 || blast.Recipients != 3 {
+		t.Fatalf("expected 3 messages, sends and archived recipients, got %d, %d and %d", messages, progress.Sent, blast.Recipients)
+	}
+}
+
+func TestBlastThatCannotSendIsPaused(t *testing.T) {
+	server := newFakeSMTPServer(t, nil)
+	s, _, listID := newTestScheduler(t, server, "a@example.com")
+	events, stop := s.progress.Subscribe()
+	defer stop()
+
+	blastID, err := s.Enqueue([]int{listID}, 0, "Hi", "Hello {{.FirstName", "http://localhost", "admin", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	blast := waitForEvent(t, s, events, blastID, ProgressPaused)
+	if blast.Status != datastore.BlastPaused || blast.LastError == "" {
+		t.Fatal("expected the reason the blast stopped")
+	}
+	if server.connections() != 0 {
+		t.Fatal("nothing should have been sent")
+	}
+
+	if err = s.Resume(blastID); err != nil {
+		t.Fatal(err)
+	}
+	blast = waitForEvent(t, s, events, blastID, ProgressPaused)
+	if blast.Status != datastore.BlastPaused || blast.LastError == "" {
+		t.Fatal("a blast that still can't send should be paused again")
+	}
+}
@@ -5,34 +5,56 @@ import (
 	"crypto/tls"
 	"fmt"
 	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
 	"net/mail"
 	"net/smtp"
-	"strings"
+	"net/textproto"
 
 	"github.com/keur/chillmailer/util"
 )
 
-func SendMail(from string, to string, subject string, body string, unsubscribeLink string) error {
-	conn, err := getConnection()
+// Email is a message to one recipient, before it is rendered.
+type Email struct {
+	From    string
+	To      string
+	Subject string
+	// Body is written in Markdown
+	Body            string
+	UnsubscribeLink string
+	// PreferencesLink is where the recipient can manage all their subscriptions
+	PreferencesLink string
+	// WebLink is where the message can be read in a browser
+	WebLink string
+	// Layout is the list's own layout, or nil for the default
+	Layout *Layout
+}
+
+func SendMail(email Email) error {
+	transport, err := NewTransportFromEnv()
 	if err != nil {
 		return err
 	}
-	return sendMessage(conn, from, to, subject, body, unsubscribeLink)
+	return transport.SendMail(email)
 }
 
-type TlsSmtpConn struct {
-	Conn *tls.Conn
+// Transport describes how to reach and authenticate with the outgoing SMTP server.
+type Transport struct {
 	Host string
+	Port string
 	Auth smtp.Auth
+	// Dial opens the raw connection to the server. When nil we use implicit TLS.
+	Dial func(addr string) (net.Conn, error)
 }
 
-func getConnection() (*TlsSmtpConn, error) {
+func NewTransportFromEnv() (*Transport, error) {
 	host, err := util.GetenvOrError("SMTP_HOST")
 	if err != nil {
 		return nil, err
 	}
 	port := util.GetenvOr("SMTP_PORT", "465")
-	server := host + ":" + port
 
 	user, err := util.GetenvOrError("SMTP_USER")
 	if err != nil {
@@ -44,111 +66,188 @@ func getConnection() (*TlsSmtpConn, error) {
 	}
 	auth := smtp.PlainAuth("", user, pass, host)
 
-	tlsconfig := &tls.Config{
-		ServerName: host,
+	return &Transport{Host: host, Port: port, Auth: auth}, nil
+}
+
+func (t *Transport) SendMail(email Email) error {
+	message, err := buildMessage(email)
+	if err != nil {
+		return err
 	}
+	c, err := t.connect()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// The server has already accepted or rejected the message by the time we
+		// quit, so a failed QUIT is not worth reporting back to the caller
+		if c.Quit() != nil {
+			c.Close()
+		}
+	}()
+	return sendMessage(c, email.From, email.To, message)
+}
 
-	// Here is the key, you need to call tls.Dial instead of smtp.Dial
-	// for smtp servers running on 465 that require an ssl connection
-	// from the very beginning (no starttls)
-	conn, err := tls.Dial("tcp", server, tlsconfig)
+// connect opens an authenticated SMTP session.
+func (t *Transport) connect() (*smtp.Client, error) {
+	conn, err := t.dial()
+	if err != nil {
+		return nil, err
+	}
+	c, err := smtp.NewClient(conn, t.Host)
 	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err = c.Auth(t.Auth); err != nil {
+		c.Close()
 		return nil, err
 	}
+	return c, nil
+}
 
-	tlsSmtpConn := &TlsSmtpConn{
-		Conn: conn,
-		Host: host,
-		Auth: auth,
+func (t *Transport) dial() (net.Conn, error) {
+	server := t.Host + ":" + t.Port
+	if t.Dial != nil {
+		return t.Dial(server)
 	}
-	return tlsSmtpConn, nil
+
+	tlsconfig := &tls.Config{
+		ServerName: t.Host,
+	}
+
+	// Here is the key, you need to call tls.Dial instead of smtp.Dial
+	// for smtp servers running on 465 that require an ssl connection
+	// from the very beginning (no starttls)
+	return tls.Dial("tcp", server, tlsconfig)
 }
 
 type EmailData struct {
 	Subject         string
 	Body            string
 	UnsubscribeLink string
+	PreferencesLink string
+	WebLink         string
 }
 
-func sendMessage(conn *TlsSmtpConn, from string, to string, subject string, body string, unsubscribeLink string) error {
-	fromAddr := mail.Address{"", from}
-	toAddr := mail.Address{"", to}
+// MessageHeader is a single header line of a rendered message.
+type MessageHeader struct {
+	Name  string
+	Value string
+}
+
+// Message is an email exactly as it goes out, kept in parts for previews.
+type Message struct {
+	Headers []MessageHeader
+	HTML    string
+	Text    string
+	// Raw is the complete message, headers included
+	Raw string
+}
 
-	c, err := smtp.NewClient(conn.Conn, conn.Host)
+// RenderMessage renders the Markdown body into a multipart/alternative message
+// with a plain text part for clients that don't show HTML.
+func RenderMessage(email Email) (*Message, error) {
+	fromAddr := mail.Address{Address: email.From}
+	toAddr := mail.Address{Address: email.To}
+
+	htmlBody, textBody, err := markdown().Render(email.Body)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	message := &Message{}
+	data := EmailData{
+		Subject:         email.Subject,
+		Body:            htmlBody,
+		UnsubscribeLink: email.UnsubscribeLink,
+		PreferencesLink: email.PreferencesLink,
+		WebLink:         email.WebLink,
+	}
+	if message.HTML, err = email.Layout.renderHTML(data); err != nil {
+		return nil, err
+	}
+	data.Body = textBody
+	if message.Text, err = email.Layout.renderText(data); err != nil {
+		return nil, err
 	}
-	defer func() {
-		if quitErr := c.Quit(); err == nil {
-			err = quitErr
-		}
-	}()
 
-	// Auth
-	if err = c.Auth(conn.Auth); err != nil {
-		return err
+	parts := new(bytes.Buffer)
+	mw := multipart.NewWriter(parts)
+	if err = writeQuotedPrintablePart(mw, "text/plain; charset=\"utf-8\"", message.Text); err != nil {
+		return nil, err
+	}
+	if err = writeQuotedPrintablePart(mw, "text/html; charset=\"utf-8\"", message.HTML); err != nil {
+		return nil, err
+	}
+	if err = mw.Close(); err != nil {
+		return nil, err
 	}
 
-	// To && From
-	if err = c.Mail(fromAddr.Address); err != nil {
-		return err
+	// Setup headers
+	message.Headers = []MessageHeader{
+		{"From", fromAddr.String()},
+		{"To", toAddr.String()},
+		{"Subject", mime.QEncoding.Encode("utf-8", email.Subject)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=\"" + mw.Boundary() + "\""},
 	}
 
-	if err = c.Rcpt(toAddr.Address); err != nil {
-		return err
+	// Setup message
+	for _, header := range message.Headers {
+		message.Raw += fmt.Sprintf("%s: %s\r\n", header.Name, header.Value)
 	}
+	message.Raw += "\r\n" + parts.String()
+	return message, nil
+}
 
-	// Data
-	w, err := c.Data()
+func buildMessage(email Email) (string, error) {
+	message, err := RenderMessage(email)
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer func() {
-		if closeErr := c.Close(); err == nil {
-			err = closeErr
-		}
-	}()
+	return message.Raw, nil
+}
 
-	// Setup headers
-	headers := make(map[string]string)
-	headers["From"] = fromAddr.String()
-	headers["To"] = toAddr.String()
-	headers["Subject"] = subject
-	headers["Content-Type"] = "text/html; charset=\"utf-8\""
+// RenderWebVersion lays out a blast body, already rendered to HTML, as a web
+// page. It has no unsubscribe footer, since it isn't for any one recipient.
+func RenderWebVersion(subject string, html string, layout *Layout) (string, error) {
+	return layout.renderHTML(EmailData{Subject: subject, Body: html})
+}
 
-	// Setup message
-	message := ""
-	for k, v := range headers {
-		message += fmt.Sprintf("%s: %s\r\n", k, v)
-	}
-	htmlBuffer := new(bytes.Buffer)
-	tmpl, err := util.NewTemplate("email.html")
+func writeQuotedPrintablePart(mw *multipart.Writer, contentType string, content string) error {
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	part, err := mw.CreatePart(header)
 	if err != nil {
 		return err
 	}
-	pageData := EmailData{Subject: subject, Body: htmlifyBody(body), UnsubscribeLink: unsubscribeLink}
-	if err = tmpl.Execute(htmlBuffer, &pageData); err != nil {
+	qp := quotedprintable.NewWriter(part)
+	if _, err = io.WriteString(qp, content); err != nil {
 		return err
 	}
-	message += "\r\n" + htmlBuffer.String()
-	_, err = io.WriteString(w, message)
-	if err != nil {
+	return qp.Close()
+}
+
+func sendMessage(c *smtp.Client, from string, to string, message string) error {
+	// To && From
+	if err := c.Mail(from); err != nil {
 		return err
 	}
 
-	return err
-}
-
-func htmlifyBody(body string) string {
-	lines := strings.Split(body, "\n")
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
 
-	var nonEmptyLines []string
-	for _, line := range lines {
-		trimmed := strings.TrimSpace(line)
-		if trimmed != "" {
-			nonEmptyLines = append(nonEmptyLines, trimmed)
-		}
+	// Data
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = io.WriteString(w, message); err != nil {
+		return err
 	}
 
-	return "<p>" + strings.Join(nonEmptyLines, "</p><p>") + "</p>"
+	// Closing the data writer is what makes the server accept or reject the message
+	return w.Close()
 }
@@ -0,0 +1,353 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/keur/chillmailer/datastore"
+	"github.com/keur/chillmailer/util"
+)
+
+// connPool returns the connection pool shared by every blast, opening it on
+// first use so that a missing SMTP configuration only fails the blast at hand.
+func (s *Scheduler) connPool() (*ConnPool, error) {
+	s.poolMutex.Lock()
+	defer s.poolMutex.Unlock()
+
+	if s.pool == nil {
+		transport, err := NewTransportFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		s.pool = NewConnPool(transport, s.config.Workers)
+	}
+	return s.pool, nil
+}
+
+// blastRun is the state shared by the workers sending one blast.
+type blastRun struct {
+	ctx       context.Context
+	blast     datastore.Blast
+	fromEmail string
+	layout    *Layout
+	merge     *MergeTemplate
+	pool      *ConnPool
+
+	// Mutex guards event, the running tally we publish after every recipient
+	Mutex *sync.Mutex
+	event ProgressEvent
+}
+
+// send works through a blast's pending recipients, checking between each one
+// whether it has been paused or cancelled. Recipients are handed to the shared
+// workers, and progress is saved per recipient.
+func (s *Scheduler) send(ctx context.Context, blast datastore.Blast) error {
+	pool, err := s.connPool()
+	if err != nil {
+		return err
+	}
+	fromEmail, err := FromAddressForList(blast.ListName)
+	if err != nil {
+		return err
+	}
+	layout, err := ListLayout(s.ds, blast.ListID)
+	if err != nil {
+		return err
+	}
+	lists, err := s.ds.QueryBlastLists(blast.ID)
+	if err != nil {
+		return err
+	}
+	listIDs := make([]int, len(lists))
+	for i, list := range lists {
+		listIDs[i] = list.ListID
+	}
+	fields, err := ListsFields(s.ds, listIDs)
+	if err != nil {
+		return err
+	}
+	merge, err := ParseMergeTags(blast.Subject, blast.Body, SampleMergeData(blast.ListName, fields))
+	if err != nil {
+		return err
+	}
+	filter, err := recipientFilter(s.ds, blast)
+	if err != nil {
+		return err
+	}
+	total, err := s.ds.SnapshotBlastRecipients(blast.ID, filter)
+	if err != nil {
+		return err
+	}
+	deliveries, err := s.ds.QueryPendingDeliveries(blast.ID)
+	if err != nil {
+		return err
+	}
+	s.logger.Info().Msgf("Sending blast %d to %d of %d recipients", blast.ID, len(deliveries), total)
+
+	progress, err := s.ds.QueryBlastProgress(blast.ID)
+	if err != nil {
+		return err
+	}
+	run := &blastRun{
+		ctx:       ctx,
+		blast:     blast,
+		fromEmail: fromEmail,
+		layout:    layout,
+		merge:     merge,
+		pool:      pool,
+		Mutex:     &sync.Mutex{},
+		event: ProgressEvent{
+			BlastID:  blast.ID,
+			ListName: blast.ListName,
+			Type:     ProgressStarted,
+			Sent:     progress.Sent,
+			Failed:   progress.Failed,
+			Total:    progress.Total,
+		},
+	}
+	s.progress.Publish(run.event)
+
+	emails := make([]string, len(deliveries))
+	for i, delivery := range deliveries {
+		emails[i] = delivery.Email
+	}
+	queues := newDomainQueues(emails)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	dispatched := 0
+	for !queues.empty() {
+		if ctx.Err() != nil {
+			s.logger.Info().Msgf("Blast %d stopped with %d recipients left", blast.ID, len(deliveries)-dispatched)
+			return nil
+		}
+
+		// Take turns between recipient domains, skipping any at their limit so a
+		// slow provider doesn't hold up everyone else
+		index, domain, ok := queues.take(s.throttle)
+		if !ok {
+			timer := time.NewTimer(throttleRetryInterval)
+			select {
+			case <-s.throttle.Released:
+			case <-timer.C:
+			case <-ctx.Done():
+			}
+			timer.Stop()
+			continue
+		}
+
+		// Wait for a free worker, unless we are told to stop first
+		select {
+		case s.workers <- struct{}{}:
+		case <-ctx.Done():
+			s.throttle.Release(domain)
+			continue
+		}
+
+		dispatched++
+		wg.Add(1)
+		go func(delivery datastore.Delivery, domain string) {
+			defer func() {
+				<-s.workers
+				s.throttle.Release(domain)
+				wg.Done()
+			}()
+			s.deliver(run, delivery)
+		}(deliveries[index], domain)
+	}
+	return nil
+}
+
+// recipientFilter picks out the blast's segment of the list, if it has one.
+// Segments are evaluated when the blast starts sending, not when it is enqueued.
+func recipientFilter(ds datastore.Datastore, blast datastore.Blast) (datastore.SubscriberFilter, error) {
+	if blast.SegmentID == 0 {
+		return datastore.SubscriberFilter{}, nil
+	}
+	segment, err := ds.GetSegment(blast.SegmentID)
+	if err != nil {
+		return datastore.SubscriberFilter{}, err
+	}
+	fields, err := ds.QueryListFields(segment.ListID)
+	if err != nil {
+		return datastore.SubscriberFilter{}, err
+	}
+	return segment.Rules.Filter(fields)
+}
+
+// throttleRetryInterval is how often we look again when every domain is at its rate limit.
+const throttleRetryInterval = 50 * time.Millisecond
+
+// deliver sends a blast to one recipient and records how it went. A recipient
+// no longer pending is left alone, such as one another run of the blast is
+// still finishing before a pause, or an address erased since we started.
+func (s *Scheduler) deliver(run *blastRun, delivery datastore.Delivery) {
+	claimed, err := s.ds.ClaimDelivery(delivery.ID)
+	if err != nil {
+		s.logger.Error().Err(err).Msgf("Could not claim delivery to %s", delivery.Email)
+		return
+	}
+	if !claimed {
+		return
+	}
+	if delivery.UnsubToken == "" {
+		s.record(run, delivery, datastore.DeliverySkipped, 0, "Unsubscribed before sending")
+		return
+	}
+
+	blast := run.blast
+	subject, body, err := run.merge.Render(SubscriberMergeData(delivery.ListName, datastore.SubscriberInfo{
+		Email:      delivery.Email,
+		FirstName:  delivery.FirstName,
+		LastName:   delivery.LastName,
+		TimeJoined: delivery.TimeJoined,
+		Fields:     delivery.Fields,
+	}))
+	if err != nil {
+		s.record(run, delivery, datastore.DeliveryFailed, 0, err.Error())
+		return
+	}
+	// Recipients on several of the blast's lists are sent it for one of them
+	unsubscribeLink := UnsubscribeLink(blast.WebRoot, delivery.ListName, delivery.Email, delivery.UnsubToken, blast.ID)
+	attempts, err := SendWithRetry(run.ctx, s.retryPolicy, func() error {
+		if err := s.quota.Take(run.ctx); err != nil {
+			return err
+		}
+		if err := s.limiter.Wait(run.ctx); err != nil {
+			s.quota.Release()
+			return err
+		}
+		if err := s.throttle.Wait(run.ctx, EmailDomain(delivery.Email)); err != nil {
+			s.quota.Release()
+			return err
+		}
+		err := run.pool.SendMail(Email{
+			From:            run.fromEmail,
+			To:              delivery.Email,
+			Subject:         subject,
+			Body:            body,
+			UnsubscribeLink: unsubscribeLink,
+			PreferencesLink: s.preferences.Link(blast.WebRoot, delivery.Email),
+			WebLink:         WebLink(blast.WebRoot, blast.PublicID),
+			Layout:          run.layout,
+		})
+		if err != nil {
+			s.quota.Release()
+		}
+		return err
+	})
+	// Stopped while waiting to send or retry, so this recipient is still pending
+	if err != nil && run.ctx.Err() != nil {
+		if err = s.ds.ReleaseDelivery(delivery.ID, attempts, ""); err != nil {
+			s.logger.Error().Err(err).Msgf("Could not release delivery to %s", delivery.Email)
+		}
+		return
+	}
+
+	status, lastError := datastore.DeliverySent, ""
+	var giveUp *GiveUpError
+	if errors.As(err, &giveUp) {
+		status, lastError = datastore.DeliveryGaveUp, err.Error()
+		s.logger.Error().Err(err).Msgf("Giving up on email to %s", delivery.Email)
+	} else if err != nil {
+		status, lastError = datastore.DeliveryFailed, err.Error()
+		s.logger.Error().Err(err).Msgf("Permanent failure sending email to %s", delivery.Email)
+	} else {
+		s.logger.Info().Msgf("Successfully sent email to %s", delivery.Email)
+	}
+	s.record(run, delivery, status, attempts, lastError)
+}
+
+func (s *Scheduler) record(run *blastRun, delivery datastore.Delivery, status datastore.DeliveryStatus, attempts int, lastError string) {
+	if err := s.ds.UpdateDelivery(delivery.ID, status, attempts, lastError); err != nil {
+		s.logger.Error().Err(err).Msgf("Could not record delivery to %s", delivery.Email)
+	}
+
+	run.Mutex.Lock()
+	defer run.Mutex.Unlock()
+
+	run.event.Type, run.event.Email, run.event.Error = ProgressSent, delivery.Email, lastError
+	if status == datastore.DeliverySent {
+		run.event.Sent++
+	} else {
+		run.event.Type = ProgressFailed
+		run.event.Failed++
+	}
+	s.progress.Publish(run.event)
+}
+
+// UnsubscribeLink leads to the page confirming an unsubscribe. blastID is the
+// blast the link is sent in, or zero, and is kept to tell which blasts people
+// leave after.
+func UnsubscribeLink(webRoot string, listName string, email string, unsubToken string, blastID int) string {
+	link := webRoot + filepath.Join("/unsubscribe", listName, email, unsubToken)
+	if blastID != 0 {
+		link += "?blast=" + strconv.Itoa(blastID)
+	}
+	return link
+}
+
+// WebLink is where anyone with the link can read a blast in their browser.
+func WebLink(webRoot string, publicID string) string {
+	return webRoot + filepath.Join("/view", publicID)
+}
+
+// FromAddressForList builds the address a list's blasts are sent from.
+func FromAddressForList(listName string) (string, error) {
+	mxDomain, err := util.GetenvOrError("MX_DOMAIN")
+	if err != nil {
+		return "", err
+	}
+	normalizedListName := util.ReplaceWhitespaceWith(listName, "-")
+	fromEmail := fmt.Sprintf("chillmailer-%s@%s", normalizedListName, mxDomain)
+	if !util.IsEmailValid(fromEmail) {
+		return "", errors.New(fmt.Sprintf("Bad email: %s", fromEmail))
+	}
+	return fromEmail, nil
+}
+
+// SendingStatus summarizes today's sending limits for the admin panel.
+type SendingStatus struct {
+	// DailyLimit is zero when there is no cap today
+	DailyLimit int
+	Remaining  int
+	// Pending is the number of recipients still waiting across all blasts
+	Pending int
+	// DaysToSend estimates how many days, today included, the pending recipients take
+	DaysToSend int
+
+	Warmup     bool
+	WarmupDay  int
+	WarmupDays int
+}
+
+func (s *Scheduler) SendingStatus() (SendingStatus, error) {
+	now := time.Now()
+	status := SendingStatus{DailyLimit: s.config.DailyLimit(now)}
+
+	remaining, err := s.quota.Remaining()
+	if err != nil {
+		return status, err
+	}
+	status.Remaining = remaining
+	if status.Pending, err = s.ds.CountPendingRecipients(); err != nil {
+		return status, err
+	}
+	status.DaysToSend = s.config.DaysToSend(status.Pending, remaining)
+
+	if plan := s.config.Warmup; plan != nil {
+		_, status.Warmup = plan.CapFor(now)
+		status.WarmupDays = len(plan.Caps)
+		// Days before the plan starts are held to its first day
+		status.WarmupDay = plan.Day(now) + 1
+		if status.WarmupDay < 1 {
+			status.WarmupDay = 1
+		}
+	}
+	return status, nil
+}
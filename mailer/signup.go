@@ -0,0 +1,334 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keur/chillmailer/datastore"
+	"github.com/keur/chillmailer/util"
+	"golang.org/x/time/rate"
+
+	"github.com/rs/zerolog/log"
+)
+
+// formTokenMaxAge is how long a form can be left open before it is submitted.
+const formTokenMaxAge = 24 * time.Hour
+
+// maxRateLimited caps how many addresses and lists are remembered for rate
+// limits, before those that have cooled down are forgotten.
+const maxRateLimited = 10000
+
+// mxLookupTimeout keeps a slow DNS server from holding up a signup.
+const mxLookupTimeout = 5 * time.Second
+
+// DisposableDomains are well known throwaway address providers, blocked unless
+// turned off. Their subdomains are blocked too.
+var DisposableDomains = []string{
+	"10minutemail.com",
+	"dispostable.com",
+	"emailondeck.com",
+	"fakeinbox.com",
+	"getnada.com",
+	"guerrillamail.com",
+	"guerrillamail.net",
+	"mailinator.com",
+	"maildrop.cc",
+	"mintemail.com",
+	"mohmal.com",
+	"sharklasers.com",
+	"temp-mail.org",
+	"tempmail.com",
+	"throwawaymail.com",
+	"trashmail.com",
+	"yopmail.com",
+}
+
+var (
+	ErrFormTokenMissing = errors.New("The form must be loaded before it is submitted")
+	ErrFormTooFast      = errors.New("The form was submitted too quickly, please try again")
+	ErrFormTokenExpired = errors.New("The form has expired, please reload the page")
+)
+
+// MXResolver looks up where a domain takes mail. *net.Resolver is one.
+type MXResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// SignupConfig decides how wary /subscribe is of who is calling it. Zero
+// values turn each check off.
+type SignupConfig struct {
+	// MinSubmitTime is how long a form must be open before it is submitted
+	MinSubmitTime time.Duration
+	// IPLimit and ListLimit cap signups per hour, from one address and to one list
+	IPLimit   int
+	ListLimit int
+	// BlockedDomains can't subscribe, nor can their subdomains
+	BlockedDomains map[string]bool
+	// CheckMX rejects domains that don't take mail
+	CheckMX bool
+}
+
+// SignupConfigFromEnv defaults to 20 signups an hour per IP address and
+// blocking DisposableDomains, along with any listed one per line in the
+// SUBSCRIBE_BLOCKED_DOMAINS_FILE.
+func SignupConfigFromEnv() SignupConfig {
+	config := SignupConfig{
+		MinSubmitTime:  util.GetenvDurationOr("SUBSCRIBE_MIN_SUBMIT_TIME", 0),
+		IPLimit:        util.GetenvIntOr("SUBSCRIBE_IP_LIMIT", 20),
+		ListLimit:      util.GetenvIntOr("SUBSCRIBE_LIST_LIMIT", 0),
+		BlockedDomains: make(map[string]bool),
+		CheckMX:        util.StringIsYes(os.Getenv("SUBSCRIBE_CHECK_MX")),
+	}
+	if util.StringIsYes(util.GetenvOr("SUBSCRIBE_BLOCK_DISPOSABLE", "yes")) {
+		for _, domain := range DisposableDomains {
+			config.BlockedDomains[domain] = true
+		}
+	}
+	if path := os.Getenv("SUBSCRIBE_BLOCKED_DOMAINS_FILE"); path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			log.Error().Err(err).Msg("Ignoring blocked domains file")
+			return config
+		}
+		defer file.Close()
+		domains, err := ParseDomainList(file)
+		if err != nil {
+			log.Error().Err(err).Msg("Ignoring blocked domains file")
+			return config
+		}
+		for _, domain := range domains {
+			config.BlockedDomains[domain] = true
+		}
+	}
+	return config
+}
+
+// ParseDomainList reads one domain per line, skipping blank lines and those
+// starting with #.
+func ParseDomainList(r io.Reader) ([]string, error) {
+	var domains []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		domains = append(domains, line)
+	}
+	return domains, scanner.Err()
+}
+
+// SignupGuard keeps bots and abuse away from /subscribe.
+type SignupGuard struct {
+	config   SignupConfig
+	secret   []byte
+	resolver MXResolver
+	// now is swapped out by tests
+	now func() time.Time
+
+	mutex        sync.Mutex
+	ipLimiters   map[string]*rate.Limiter
+	listLimiters map[string]*rate.Limiter
+}
+
+func NewSignupGuard(config SignupConfig, secret string, resolver MXResolver) *SignupGuard {
+	return &SignupGuard{
+		config:       config,
+		secret:       []byte(secret),
+		resolver:     resolver,
+		now:          time.Now,
+		ipLimiters:   make(map[string]*rate.Limiter),
+		listLimiters: make(map[string]*rate.Limiter),
+	}
+}
+
+// SignupGuardFromEnv signs form tokens with SUBSCRIBE_SECRET, or else a secret
+// generated and kept in the database, and looks up MX records with the system
+// resolver.
+func SignupGuardFromEnv(ds datastore.Datastore) (*SignupGuard, error) {
+	secret := util.GetenvOr("SUBSCRIBE_SECRET", "")
+	if secret == "" {
+		var err error
+		if secret, err = ds.LoadSecret("subscribe"); err != nil {
+			return nil, err
+		}
+	}
+	warnFieldClashes(ds)
+	return NewSignupGuard(SignupConfigFromEnv(), secret, net.DefaultResolver), nil
+}
+
+// warnFieldClashes points out custom fields made before their names were
+// reserved for signup forms, since values sent for them are taken as ours.
+func warnFieldClashes(ds datastore.Datastore) {
+	lists, err := ds.QueryAllMailingLists()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not check custom fields against the signup form")
+		return
+	}
+	for _, list := range lists {
+		listID, err := ds.GetMailingListID(list.Name)
+		if err != nil {
+			log.Error().Err(err).Msgf("Could not check custom fields of list %s", list.Name)
+			continue
+		}
+		fields, err := ds.QueryListFields(listID)
+		if err != nil {
+			log.Error().Err(err).Msgf("Could not check custom fields of list %s", list.Name)
+			continue
+		}
+		for _, field := range fields {
+			if field.Name == datastore.HoneypotField || field.Name == datastore.FormTokenField {
+				log.Warn().Msgf("Custom field %s of list %s clashes with the signup form, rename it", field.Name, list.Name)
+			}
+		}
+	}
+}
+
+func (g *SignupGuard) sign(issued string) string {
+	mac := hmac.New(sha256.New, g.secret)
+	mac.Write([]byte(issued))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// FormToken records when a form was loaded, signed so it can't be backdated.
+func (g *SignupGuard) FormToken() string {
+	issued := strconv.FormatInt(g.now().Unix(), 10)
+	return issued + "." + g.sign(issued)
+}
+
+// CheckFormToken makes sure the form was open long enough before it was
+// submitted, and not for so long that the token could have been farmed. It
+// accepts anything when there is no minimum time.
+func (g *SignupGuard) CheckFormToken(token string) error {
+	if g.config.MinSubmitTime <= 0 {
+		return nil
+	}
+	issued, signature, found := strings.Cut(token, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(g.sign(issued))) {
+		return ErrFormTokenMissing
+	}
+	seconds, err := strconv.ParseInt(issued, 10, 64)
+	if err != nil {
+		return ErrFormTokenMissing
+	}
+	age := g.now().Sub(time.Unix(seconds, 0))
+	if age < g.config.MinSubmitTime {
+		return ErrFormTooFast
+	}
+	if age > formTokenMaxAge {
+		return ErrFormTokenExpired
+	}
+	return nil
+}
+
+// limiter returns key's hourly allowance, or nil when there is no limit.
+func (g *SignupGuard) limiter(limiters map[string]*rate.Limiter, key string, perHour int, now time.Time) *rate.Limiter {
+	if perHour <= 0 {
+		return nil
+	}
+	limiter, ok := limiters[key]
+	if !ok {
+		if len(limiters) >= maxRateLimited {
+			for k, l := range limiters {
+				if l.TokensAt(now) >= float64(l.Burst()) {
+					delete(limiters, k)
+				}
+			}
+		}
+		limiter = rate.NewLimiter(rate.Every(time.Hour/time.Duration(perHour)), perHour)
+		limiters[key] = limiter
+	}
+	return limiter
+}
+
+// Allow counts a signup from the IP address to the list, telling if both are
+// still under their hourly limit. A signup turned away by one limit isn't
+// counted against the other.
+func (g *SignupGuard) Allow(ip string, listName string) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	now := g.now()
+	limiters := []*rate.Limiter{
+		g.limiter(g.ipLimiters, ip, g.config.IPLimit, now),
+		g.limiter(g.listLimiters, listName, g.config.ListLimit, now),
+	}
+	for _, limiter := range limiters {
+		if limiter != nil && limiter.TokensAt(now) < 1 {
+			return false
+		}
+	}
+	for _, limiter := range limiters {
+		if limiter != nil {
+			limiter.AllowN(now, 1)
+		}
+	}
+	return true
+}
+
+// IsBlockedDomain tells if the address is at a blocked domain or one of its
+// subdomains.
+func (g *SignupGuard) IsBlockedDomain(email string) bool {
+	domain := EmailDomain(email)
+	for {
+		if g.config.BlockedDomains[domain] {
+			return true
+		}
+		_, parent, found := strings.Cut(domain, ".")
+		if !found {
+			return false
+		}
+		domain = parent
+	}
+}
+
+// CheckMX makes sure the address's domain takes mail, either through its MX
+// records or, lacking any, its own address. Lookups that fail for any reason
+// but the domain not existing let the address through, so a DNS outage
+// doesn't stop signups.
+func (g *SignupGuard) CheckMX(ctx context.Context, email string) error {
+	if !g.config.CheckMX {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, mxLookupTimeout)
+	defer cancel()
+
+	domain := EmailDomain(email)
+	noMail := errors.New(fmt.Sprintf("%s doesn't accept mail", domain))
+	records, err := g.resolver.LookupMX(ctx, domain)
+	if err == nil && len(records) > 0 {
+		// A lone "." means the domain takes no mail at all
+		if len(records) == 1 && records[0].Host == "." {
+			return noMail
+		}
+		return nil
+	}
+	if err != nil && !isNotFound(err) {
+		log.Warn().Err(err).Msgf("Could not look up MX records for %s", domain)
+		return nil
+	}
+	if _, err = g.resolver.LookupHost(ctx, domain); err != nil {
+		if isNotFound(err) {
+			return noMail
+		}
+		log.Warn().Err(err).Msgf("Could not look up %s", domain)
+	}
+	return nil
+}
+
+func isNotFound(err error) bool {
+	var dnsError *net.DNSError
+	return errors.As(err, &dnsError) && dnsError.IsNotFound
+}
@@ -0,0 +1,167 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormTokenTiming(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	guard := NewSignupGuard(SignupConfig{MinSubmitTime: 3 * time.Second}, "secret", nil)
+	guard.now = func() time.Time { return now }
+	token := guard.FormToken()
+
+	if err := guard.CheckFormToken(token); err != ErrFormTooFast {
+		t.Errorf("expected a form submitted at once to be too fast, got %v", err)
+	}
+	now = now.Add(5 * time.Second)
+	if err := guard.CheckFormToken(token); err != nil {
+		t.Errorf("expected the token to be accepted, got %v", err)
+	}
+	now = now.Add(formTokenMaxAge)
+	if err := guard.CheckFormToken(token); err != ErrFormTokenExpired {
+		t.Errorf("expected an old token to have expired, got %v", err)
+	}
+
+	issued, signature, _ := strings.Cut(token, ".")
+	for _, bad := range []string{"", "no-dot", "1." + signature, issued + ".forged"} {
+		if err := guard.CheckFormToken(bad); err != ErrFormTokenMissing {
+			t.Errorf("expected token %q to be refused, got %v", bad, err)
+		}
+	}
+	if err := NewSignupGuard(SignupConfig{}, "secret", nil).CheckFormToken(""); err != nil {
+		t.Errorf("tokens shouldn't be needed without a minimum time, got %v", err)
+	}
+}
+
+func TestSignupRateLimits(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	guard := NewSignupGuard(SignupConfig{IPLimit: 2, ListLimit: 3}, "secret", nil)
+	guard.now = func() time.Time { return now }
+
+	if !guard.Allow("10.0.0.1", "Blog") || !guard.Allow("10.0.0.1", "Blog") {
+		t.Fatal("the first signups from an address should be allowed")
+	}
+	if guard.Allow("10.0.0.1", "Blog") {
+		t.Error("an address over its limit was allowed")
+	}
+	if !guard.Allow("10.0.0.2", "Blog") {
+		t.Error("another address should have its own limit")
+	}
+	if guard.Allow("10.0.0.3", "Blog") {
+		t.Error("a list over its limit was allowed")
+	}
+	if !guard.Allow("10.0.0.3", "Releases") {
+		t.Error("another list should have its own limit")
+	}
+
+	now = now.Add(30 * time.Minute)
+	if !guard.Allow("10.0.0.1", "Releases") {
+		t.Error("an address should get signups back as time passes")
+	}
+}
+
+func TestListLimitDoesNotSpendAddressLimit(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	guard := NewSignupGuard(SignupConfig{IPLimit: 1, ListLimit: 1}, "secret", nil)
+	guard.now = func() time.Time { return now }
+
+	if !guard.Allow("10.0.0.1", "Blog") {
+		t.Fatal("the first signup to a list should be allowed")
+	}
+	if guard.Allow("10.0.0.2", "Blog") {
+		t.Fatal("a list over its limit was allowed")
+	}
+	if !guard.Allow("10.0.0.2", "Releases") {
+		t.Error("a signup turned away by the list's limit used up the address's")
+	}
+}
+
+func TestBlockedDomains(t *testing.T) {
+	domains, err := ParseDomainList(strings.NewReader("# throwaways\nMailinator.com\n\n  example.net  \n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"mailinator.com", "example.net"}; !reflect.DeepEqual(domains, expected) {
+		t.Fatalf("expected %v, got %v", expected, domains)
+	}
+
+	guard := NewSignupGuard(SignupConfig{BlockedDomains: map[string]bool{"mailinator.com": true}}, "secret", nil)
+	for email, blocked := range map[string]bool{
+		"a@mailinator.com":        true,
+		"a@MAILINATOR.com":        true,
+		"a@eu.mailinator.com":     true,
+		"a@notmailinator.com":     false,
+		"a@mailinator.com.au":     false,
+		"a@example.com":           false,
+		"a@mailinator.example.io": false,
+	} {
+		if guard.IsBlockedDomain(email) != blocked {
+			t.Errorf("expected %s blocked to be %v", email, blocked)
+		}
+	}
+}
+
+// fakeResolver answers lookups from maps, failing with a not found error for
+// any domain in neither.
+type fakeResolver struct {
+	mx    map[string][]*net.MX
+	hosts map[string][]string
+	err   error
+}
+
+func (f fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if records, ok := f.mx[name]; ok {
+		return records, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (f fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if addrs, ok := f.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestCheckMX(t *testing.T) {
+	resolver := fakeResolver{
+		mx: map[string][]*net.MX{
+			"example.com": {{Host: "mx.example.com.", Pref: 10}},
+			"nomail.com":  {{Host: ".", Pref: 0}},
+		},
+		hosts: map[string][]string{"hostonly.com": {"192.0.2.1"}},
+	}
+	guard := NewSignupGuard(SignupConfig{CheckMX: true}, "secret", resolver)
+	for email, ok := range map[string]bool{
+		"a@example.com":  true,
+		"a@Example.COM":  true,
+		"a@hostonly.com": true,
+		"a@nomail.com":   false,
+		"a@missing.com":  false,
+	} {
+		if err := guard.CheckMX(context.Background(), email); (err == nil) != ok {
+			t.Errorf("expected %s to pass as %v, got %v", email, ok, err)
+		}
+	}
+
+	flaky := NewSignupGuard(SignupConfig{CheckMX: true}, "secret", fakeResolver{err: &net.DNSError{Err: "server misbehaving", IsTemporary: true}})
+	if err := flaky.CheckMX(context.Background(), "a@example.com"); err != nil {
+		t.Errorf("a failing resolver shouldn't stop signups, got %v", err)
+	}
+	unchecked := NewSignupGuard(SignupConfig{}, "secret", fakeResolver{err: errors.New("should not be called")})
+	if err := unchecked.CheckMX(context.Background(), "a@missing.com"); err != nil {
+		t.Errorf("MX records shouldn't be checked unless asked for, got %v", err)
+	}
+}
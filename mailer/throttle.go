@@ -0,0 +1,192 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// DomainLimit throttles mail to a single recipient domain. A zero Rate or
+// Concurrency leaves that side of it unlimited.
+type DomainLimit struct {
+	Rate        float64
+	Concurrency int
+}
+
+// DefaultDomain holds the limit for every domain not listed on its own.
+const DefaultDomain = "*"
+
+// ParseDomainLimits reads comma separated domain:rate:concurrency entries, such
+// as "gmail.com:2:3,yahoo.com:1:1,*:5:5", where rate is messages per second.
+func ParseDomainLimits(spec string) (map[string]DomainLimit, error) {
+	limits := make(map[string]DomainLimit)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		fields := strings.Split(entry, ":")
+		if len(fields) != 3 {
+			return nil, errors.New(fmt.Sprintf("Invalid domain limit: %s", entry))
+		}
+		limitRate, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || limitRate < 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid rate in domain limit: %s", entry))
+		}
+		concurrency, err := strconv.Atoi(fields[2])
+		if err != nil || concurrency < 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid concurrency in domain limit: %s", entry))
+		}
+		limits[strings.ToLower(fields[0])] = DomainLimit{Rate: limitRate, Concurrency: concurrency}
+	}
+	return limits, nil
+}
+
+// EmailDomain returns the lower cased domain of an address.
+func EmailDomain(email string) string {
+	return strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+}
+
+// DomainThrottle enforces per-domain limits on top of the global rate limit.
+// It never blocks. Callers try a domain, and move on to another if it is busy.
+type DomainThrottle struct {
+	Mutex    *sync.Mutex
+	Limits   map[string]DomainLimit
+	limiters map[string]*rate.Limiter
+	inFlight map[string]int
+	// Released is signalled whenever a slot frees up
+	Released chan struct{}
+}
+
+func NewDomainThrottle(limits map[string]DomainLimit) *DomainThrottle {
+	return &DomainThrottle{
+		Mutex:    &sync.Mutex{},
+		Limits:   limits,
+		limiters: make(map[string]*rate.Limiter),
+		inFlight: make(map[string]int),
+		Released: make(chan struct{}, 1),
+	}
+}
+
+func (t *DomainThrottle) limitFor(domain string) (DomainLimit, bool) {
+	if limit, ok := t.Limits[domain]; ok {
+		return limit, true
+	}
+	limit, ok := t.Limits[DefaultDomain]
+	return limit, ok
+}
+
+func (t *DomainThrottle) limiterFor(domain string, limit DomainLimit) *rate.Limiter {
+	limiter, ok := t.limiters[domain]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(limit.Rate), 1)
+		t.limiters[domain] = limiter
+	}
+	return limiter
+}
+
+// TryAcquire claims a send to the domain if it is under its concurrency cap and
+// its rate would let a message through now. The rate is only taken by Wait,
+// right before sending. A successful claim must be given back with Release.
+func (t *DomainThrottle) TryAcquire(domain string) bool {
+	t.Mutex.Lock()
+	defer t.Mutex.Unlock()
+
+	limit, ok := t.limitFor(domain)
+	if !ok {
+		t.inFlight[domain]++
+		return true
+	}
+	if limit.Concurrency > 0 && t.inFlight[domain] >= limit.Concurrency {
+		return false
+	}
+	if limit.Rate > 0 && t.limiterFor(domain, limit).TokensAt(time.Now()) < 1 {
+		return false
+	}
+	t.inFlight[domain]++
+	return true
+}
+
+// Wait blocks until the domain's rate allows another message. It is called
+// before every send attempt, retries included.
+func (t *DomainThrottle) Wait(ctx context.Context, domain string) error {
+	t.Mutex.Lock()
+	limit, ok := t.limitFor(domain)
+	if !ok || limit.Rate <= 0 {
+		t.Mutex.Unlock()
+		return nil
+	}
+	limiter := t.limiterFor(domain, limit)
+	t.Mutex.Unlock()
+	return limiter.Wait(ctx)
+}
+
+func (t *DomainThrottle) Release(domain string) {
+	t.Mutex.Lock()
+	t.inFlight[domain]--
+	if t.inFlight[domain] <= 0 {
+		delete(t.inFlight, domain)
+	}
+	t.Mutex.Unlock()
+
+	select {
+	case t.Released <- struct{}{}:
+	default:
+	}
+}
+
+// domainQueues splits deliveries up by recipient domain, keeping their order
+// within each domain, so the sender can take turns between domains.
+type domainQueues struct {
+	domains []string
+	queues  map[string][]int
+	next    int
+}
+
+func newDomainQueues(emails []string) *domainQueues {
+	q := &domainQueues{queues: make(map[string][]int)}
+	for i, email := range emails {
+		domain := EmailDomain(email)
+		if _, ok := q.queues[domain]; !ok {
+			q.domains = append(q.domains, domain)
+		}
+		q.queues[domain] = append(q.queues[domain], i)
+	}
+	return q
+}
+
+func (q *domainQueues) empty() bool {
+	return len(q.domains) == 0
+}
+
+// take returns the index of the next email from the first domain, in turn,
+// that the throttle lets through. It returns false if every domain is busy.
+func (q *domainQueues) take(throttle *DomainThrottle) (int, string, bool) {
+	for tried := 0; tried < len(q.domains); tried++ {
+		if q.next >= len(q.domains) {
+			q.next = 0
+		}
+		domain := q.domains[q.next]
+		if !throttle.TryAcquire(domain) {
+			q.next++
+			continue
+		}
+
+		index := q.queues[domain][0]
+		q.queues[domain] = q.queues[domain][1:]
+		if len(q.queues[domain]) == 0 {
+			delete(q.queues, domain)
+			q.domains = append(q.domains[:q.next], q.domains[q.next+1:]...)
+		} else {
+			q.next++
+		}
+		return index, domain, true
+	}
+	return 0, "", false
+}
@@ -0,0 +1,89 @@
+package mailer
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDomainQueuesInterleave(t *testing.T) {
+	emails := []string{"a@gmail.com", "b@gmail.com", "c@gmail.com", "d@yahoo.com", "e@Yahoo.com", "f@example.com"}
+	queues := newDomainQueues(emails)
+	throttle := NewDomainThrottle(nil)
+
+	var order []string
+	for !queues.empty() {
+		index, _, ok := queues.take(throttle)
+		if !ok {
+			t.Fatal("unthrottled domains should never be busy")
+		}
+		order = append(order, emails[index])
+	}
+	expected := []string{"a@gmail.com", "d@yahoo.com", "f@example.com", "b@gmail.com", "e@Yahoo.com", "c@gmail.com"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Fatalf("expected %v, got %v", expected, order)
+	}
+}
+
+func TestBusyDomainIsSkipped(t *testing.T) {
+	limits, err := ParseDomainLimits("gmail.com:0:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	throttle := NewDomainThrottle(limits)
+	emails := []string{"a@gmail.com", "b@gmail.com", "c@yahoo.com"}
+	queues := newDomainQueues(emails)
+
+	first, _, _ := queues.take(throttle)
+	second, _, _ := queues.take(throttle)
+	if emails[first] != "a@gmail.com" || emails[second] != "c@yahoo.com" {
+		t.Fatalf("expected gmail then yahoo, got %s then %s", emails[first], emails[second])
+	}
+	if _, _, ok := queues.take(throttle); ok {
+		t.Fatal("gmail.com should be at its concurrency cap")
+	}
+
+	throttle.Release("gmail.com")
+	third, _, ok := queues.take(throttle)
+	if !ok || emails[third] != "b@gmail.com" {
+		t.Fatal("gmail.com should be free again after a release")
+	}
+}
+
+func TestDomainRateIsTakenWhenSending(t *testing.T) {
+	limits, err := ParseDomainLimits("gmail.com:1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	throttle := NewDomainThrottle(limits)
+	if !throttle.TryAcquire("gmail.com") || !throttle.TryAcquire("gmail.com") {
+		t.Fatal("acquiring should not use up the rate")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err = throttle.Wait(ctx, "gmail.com"); err != nil {
+		t.Fatalf("first send should go right away, got %v", err)
+	}
+	if throttle.TryAcquire("gmail.com") {
+		t.Fatal("gmail.com should be at its rate after a send")
+	}
+	if err = throttle.Wait(ctx, "gmail.com"); err == nil {
+		t.Fatal("a retry should wait for the rate too")
+	}
+}
+
+func TestParseDomainLimitsDefault(t *testing.T) {
+	limits, err := ParseDomainLimits("gmail.com:2:3, *:5:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	throttle := NewDomainThrottle(limits)
+	if limit, _ := throttle.limitFor("example.com"); limit.Concurrency != 1 {
+		t.Fatalf("unlisted domains should use the default limit, got %+v", limit)
+	}
+	if _, err = ParseDomainLimits("gmail.com:fast:1"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,86 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WarmupPlan ramps up sending volume on a new IP or domain. Caps[0] is the most
+// we send on the start day, Caps[1] the day after, and so on. Once the plan runs
+// out, only the regular daily quota applies.
+type WarmupPlan struct {
+	Start time.Time
+	Caps  []int
+}
+
+// ParseWarmupPlan reads a comma separated list of daily caps, such as
+// "50,100,250", starting on the given YYYY-MM-DD date.
+func ParseWarmupPlan(schedule string, start string) (*WarmupPlan, error) {
+	plan := &WarmupPlan{}
+	for _, field := range strings.Split(schedule, ",") {
+		limit, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || limit < 1 {
+			return nil, errors.New(fmt.Sprintf("Invalid warm-up cap: %s", field))
+		}
+		plan.Caps = append(plan.Caps, limit)
+	}
+	startDay, err := time.Parse("2006-01-02", start)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid warm-up start date: %s", start))
+	}
+	plan.Start = startOfDay(startDay)
+	return plan, nil
+}
+
+// Day returns which day of the plan the given day is, counting from zero.
+func (p *WarmupPlan) Day(day time.Time) int {
+	return int(startOfDay(day).Sub(p.Start) / (24 * time.Hour))
+}
+
+// CapFor returns the warm-up cap on a given day, and whether one applies.
+// Days before the plan starts get the first day's cap.
+func (p *WarmupPlan) CapFor(day time.Time) (int, bool) {
+	n := p.Day(day)
+	if n < 0 {
+		n = 0
+	}
+	if n >= len(p.Caps) {
+		return 0, false
+	}
+	return p.Caps[n], true
+}
+
+// DailyLimit combines the daily quota with any warm-up cap. Zero means no cap.
+func (c SendConfig) DailyLimit(day time.Time) int {
+	limit := c.DailyQuota
+	if c.Warmup != nil {
+		if warmupCap, ok := c.Warmup.CapFor(day); ok && (limit == 0 || warmupCap < limit) {
+			limit = warmupCap
+		}
+	}
+	return limit
+}
+
+// DaysToSend estimates how many days, today included, it takes to send n more
+// messages given what is left today. It returns -1 when there is no cap.
+func (c SendConfig) DaysToSend(n int, remainingToday int) int {
+	if remainingToday < 0 {
+		return -1
+	}
+	days := 1
+	n -= remainingToday
+	day := startOfDay(time.Now())
+	for n > 0 {
+		day = day.Add(24 * time.Hour)
+		limit := c.DailyLimit(day)
+		if limit == 0 {
+			return days + 1
+		}
+		n -= limit
+		days++
+	}
+	return days
+}
@@ -0,0 +1,42 @@
+package mailer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWarmupCapsCombineWithQuota(t *testing.T) {
+	today := startOfDay(time.Now())
+	plan, err := ParseWarmupPlan("50, 100, 250", today.Format("2006-01-02"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := SendConfig{DailyQuota: 200, Warmup: plan}
+
+	day := 24 * time.Hour
+	for i, expected := range []int{50, 100, 200, 200} {
+		if limit := config.DailyLimit(today.Add(time.Duration(i) * day)); limit != expected {
+			t.Fatalf("day %d: expected cap %d, got %d", i, expected, limit)
+		}
+	}
+	if limit := config.DailyLimit(today.Add(-day)); limit != 50 {
+		t.Fatalf("expected the first cap before the plan starts, got %d", limit)
+	}
+
+	// 20 left today, then 100 and 200 a day after that
+	if days := config.DaysToSend(300, 20); days != 3 {
+		t.Fatalf("expected 3 days, got %d", days)
+	}
+	if days := (SendConfig{}).DaysToSend(300, -1); days != -1 {
+		t.Fatalf("expected no estimate without a cap, got %d", days)
+	}
+}
+
+func TestParseWarmupPlanRejectsBadCaps(t *testing.T) {
+	if _, err := ParseWarmupPlan("50,lots", "2026-10-01"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, err := ParseWarmupPlan("50", "October"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"database/sql"
 	"errors"
 	"fmt"
 	"html"
@@ -24,7 +23,6 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/hlog"
 	"github.com/rs/zerolog/log"
-	"golang.org/x/time/rate"
 )
 
 func setupLogger(ctx context.Context) (context.Context, *zerolog.Logger) {
@@ -65,25 +63,95 @@ func setupRouter(ctx context.Context, logger *zerolog.Logger, ds datastore.Datas
 	filesDir := http.Dir(filepath.Join(workDir, "static"))
 	fileserver(r, "/static", filesDir)
 
-	r.Post("/subscribe", serveSubscribe(ds))
-	r.Get("/unsubscribe/{listName}/{email}/{unsubToken}", serveUnsubscribe(ds))
+	preferences, err := mailer.PreferenceSignerFromEnv(ds)
+	if err != nil {
+		logger.Panic().Err(err).Msg("could not load the preferences secret!")
+	}
+
+	signupGuard, err := mailer.SignupGuardFromEnv(ds)
+	if err != nil {
+		logger.Panic().Err(err).Msg("could not load the subscribe secret!")
+	}
+
+	r.Post("/subscribe", serveSubscribe(ds, signupGuard))
+	r.Get("/subscribe/token", serveSubscribeToken(signupGuard))
+	r.Get("/unsubscribe/{listName}/{email}/{unsubToken}", serveUnsubscribePage(ds))
+	r.Post("/unsubscribe/{listName}/{email}/{unsubToken}", serveUnsubscribe(ds))
+	r.Get("/view/{publicID}", serveWebVersion(ds))
+	r.Get("/archive/{listName}", servePublicArchive(ds))
+	r.Get("/archive/{listName}/feed.atom", servePublicFeed(ds))
+	r.Get("/archive/{listName}/{blastID}", servePublicBlast(ds))
+	r.Get("/preferences/{token}", servePreferences(ds, preferences))
+	r.Post("/preferences/{token}/lists", serveUpdatePreferenceLists(ds, preferences))
+	r.Post("/preferences/{token}/pause", servePauseSubscriptions(ds, preferences))
+	r.Post("/preferences/{token}/email", serveChangeEmail(ds, preferences))
+	r.Post("/preferences/{token}/fields/{listName}", serveUpdatePreferenceFields(ds, preferences))
+	r.Get("/preferences/confirm/{changeToken}", serveConfirmEmailChange(ds, preferences))
 
 	r.Get("/", func(writer http.ResponseWriter, req *http.Request) {
 		http.Redirect(writer, req, "/admin", http.StatusMovedPermanently)
 	})
 
-	// Shared rate limiter for outgoing emails. AWS SES limits us to 1 email per second
-	limiter := rate.NewLimiter(1, 1)
+	// Outgoing email limits depend on the relay. AWS SES defaults to 1 email per second
+	sendConfig := mailer.SendConfigFromEnv()
+	retryPolicy := mailer.RetryPolicyFromEnv()
+
+	mailCanceller := mailer.NewMailCanceller()
+	progressHub := mailer.NewProgressHub()
+	scheduler := mailer.NewScheduler(logger, ds, mailCanceller, sendConfig, retryPolicy, progressHub, preferences)
+	if err := scheduler.Start(); err != nil {
+		logger.Panic().Err(err).Msg("could not restore scheduled blasts!")
+	}
 
 	// Admin routes require basic auth
 	adminRouter := r.With(middleware.BasicAuth)
-	mailCanceller := mailer.NewMailCanceller()
 	adminRouter.Route("/admin", func(r chi.Router) {
-		r.Get("/", serveIndex(ds))
-		r.Get("/list/display/{listName}", serveDisplayList(ds, mailCanceller))
-		r.Get("/list/cancel/{listName}", serveCancelList(logger, mailCanceller))
+		r.Get("/", serveIndex(ds, scheduler))
+		r.Get("/list/display/{listName}", serveDisplayList(ds, scheduler))
+		r.Get("/list/cancel/{listName}", serveCancelList(logger, ds, scheduler))
+		r.Get("/list/archive/{listName}", serveListArchive(ds))
+		r.Post("/list/archive-visibility/{listName}", serveSetArchiveVisibility(ds))
+		r.Get("/list/layout/{listName}", serveListLayout(ds))
+		r.Post("/list/layout/{listName}", serveSaveListLayout(ds))
+		r.Post("/list/grace-period/{listName}", serveSetGracePeriod(ds))
+		r.Post("/list/fields/{listName}", serveCreateListField(ds))
+		r.Post("/list/fields/{listName}/delete/{fieldName}", serveDeleteListField(ds))
+		r.Post("/subscriber/fields/{listName}", serveUpdateSubscriberFields(ds))
+		r.Post("/subscriber/tags/{listName}", serveUpdateSubscriberTags(ds))
+		r.Post("/subscriber/remove/{listName}", serveRemoveSubscriber(ds))
+		r.Post("/list/segments/{listName}", serveCreateSegment(ds))
+		r.Post("/list/segments/{listName}/delete/{segmentID}", serveDeleteSegment(ds))
+		r.Get("/list/import/{listName}", serveImportPage(ds))
+		r.Post("/list/import/{listName}", serveImport(ds))
+		r.Get("/list/import/{listName}/report/{importID}", serveImportReport(ds))
+		r.Get("/export", serveExport(ds))
+		r.Get("/export/{listName}", serveExport(ds))
+		r.Get("/subject", serveSubjectPage(ds))
+		r.Post("/subject/erase", serveEraseSubject(ds))
+		r.Get("/api/subject", serveSubjectAPI(ds))
+		r.Post("/api/subject/erase", serveEraseSubjectAPI(ds))
+		r.Get("/suppressions", serveSuppressions(ds))
+		r.Post("/suppressions", serveAddSuppression(ds))
+		r.Post("/suppressions/remove", serveRemoveSuppression(ds))
+		r.Get("/api/subscribers/{listName}", serveSubscribersAPI(ds))
+		r.Get("/api/recipient-count/{listName}", serveRecipientCount(ds))
+		r.Get("/scheduled", serveScheduledBlasts(ds))
+		r.Get("/blast/cancel/{blastID}", serveCancelBlast(logger, scheduler))
+		r.Get("/blast/send-now/{blastID}", serveSendBlastNow(logger, scheduler))
+		r.Get("/blast/pause/{blastID}", servePauseBlast(logger, scheduler))
+		r.Get("/blast/resume/{blastID}", serveResumeBlast(logger, scheduler))
+		r.Get("/blast/status/{blastID}", serveBlastStatus(ds))
+		r.Get("/blast/view/{blastID}", serveArchivedBlast(ds))
+		r.Post("/blast/duplicate/{blastID}", serveDuplicateBlast(ds))
+		r.Get("/events", serveProgressEvents(ds, progressHub))
+		r.Post("/blast/reschedule/{blastID}", serveRescheduleBlast(logger, scheduler))
+		r.Post("/blast/edit/{blastID}", serveEditBlast(ds))
 		r.Post("/create-list", serveCreateList(ds))
-		r.Post("/enqueue-mail", serveEnqueueMail(logger, ds, mailCanceller, limiter))
+		r.Post("/enqueue-mail", serveEnqueueMail(logger, ds, scheduler))
+		r.Post("/draft/save", serveSaveDraft(ds))
+		r.Get("/draft/delete/{draftID}", serveDeleteDraft(ds))
+		r.Post("/preview-mail", servePreviewMail(ds))
+		r.Post("/send-test-mail", serveSendTestMail(logger, ds, preferences))
 	})
 
 	return ctx, r
@@ -105,6 +173,15 @@ func main() {
 	if err != nil {
 		logger.Panic().Err(err).Msg("could not initialize sqlite database file!")
 	}
+
+	if len(os.Args) > 1 {
+		if err = runCommand(datastore, os.Args[1:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			datastore.Close()
+			os.Exit(1)
+		}
+		return
+	}
 	logger.Info().Msgf("Initialized database file: %s", databaseFile)
 
 	serverCtx, r := setupRouter(serverCtx, logger, datastore)
@@ -157,10 +234,11 @@ func fileserver(r chi.Router, path string, root http.FileSystem) {
 }
 
 type IndexData struct {
-	Infos []datastore.MailingListInfo
+	Infos   []datastore.MailingListInfo
+	Sending mailer.SendingStatus
 }
 
-func serveIndex(ds datastore.Datastore) http.HandlerFunc {
+func serveIndex(ds datastore.Datastore, scheduler *mailer.Scheduler) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		webRoot := util.GetWebRoot(r)
 		log.Info().Msgf("Webroot is %s", webRoot)
@@ -169,12 +247,17 @@ func serveIndex(ds datastore.Datastore) http.HandlerFunc {
 			util.ServerError(w, err)
 			return
 		}
+		sending, err := scheduler.SendingStatus()
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
 		tmpl, err := util.NewTemplate("index.html")
 		if err != nil {
 			util.ServerError(w, err)
 			return
 		}
-		if err = tmpl.Execute(w, IndexData{Infos: infos}); err != nil {
+		if err = tmpl.Execute(w, IndexData{Infos: infos, Sending: sending}); err != nil {
 			util.ServerError(w, err)
 			return
 		}
@@ -186,7 +269,19 @@ type TimedMessagePageData struct {
 	Message string
 }
 
-func serveSubscribe(ds datastore.Datastore) http.HandlerFunc {
+// maxNameLength caps the optional names subscribers give us, in bytes.
+const maxNameLength = 100
+
+// remoteIP is the caller's address without its port, as set by the RealIP
+// middleware.
+func remoteIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+func serveSubscribe(ds datastore.Datastore, guard *mailer.SignupGuard) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		err := r.ParseForm()
 		if err != nil {
@@ -199,6 +294,16 @@ func serveSubscribe(ds datastore.Datastore) http.HandlerFunc {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
+		// Bots are told they succeeded, so they don't learn to leave it empty
+		if util.FormValue(r, datastore.HoneypotField) != "" {
+			log.Info().Msgf("Ignoring signup from %s with the honeypot filled in", remoteIP(r))
+			serveTimedMessage(w, TimedMessagePageData{Title: "Subscribed", Message: "You have been subscribed."})
+			return
+		}
+		if err = guard.CheckFormToken(util.FormValue(r, datastore.FormTokenField)); err != nil {
+			util.UserError(w, err.Error())
+			return
+		}
 		if html.EscapeString(email) != email {
 			util.Forbidden(w, "Goodbye")
 			return
@@ -207,6 +312,25 @@ func serveSubscribe(ds datastore.Datastore) http.HandlerFunc {
 			util.UserError(w, fmt.Sprintf("Provided invalid email: %s", email))
 			return
 		}
+		if guard.IsBlockedDomain(email) {
+			util.UserError(w, fmt.Sprintf("Addresses at %s can't subscribe", mailer.EmailDomain(email)))
+			return
+		}
+		suppressed, err := ds.IsSuppressed(email)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if suppressed {
+			util.UserError(w, fmt.Sprintf("%s can no longer be subscribed", email))
+			return
+		}
+		firstName := util.FormValue(r, "first_name")
+		lastName := util.FormValue(r, "last_name")
+		if len(firstName) > maxNameLength || len(lastName) > maxNameLength {
+			util.UserError(w, "Provided name is too long")
+			return
+		}
 		listID, err := ds.GetMailingListID(list)
 		if err != nil {
 			util.ServerError(w, err)
@@ -217,8 +341,28 @@ func serveSubscribe(ds datastore.Datastore) http.HandlerFunc {
 			return
 		}
 
+		listFields, err := ds.QueryListFields(listID)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		fields, err := parseSubscriberFields(r, listFields)
+		if err != nil {
+			util.UserError(w, err.Error())
+			return
+		}
+		// Limits are only used up by signups that could otherwise go through
+		if !guard.Allow(remoteIP(r), list) {
+			util.TooManyRequests(w, "Too many signups, please try again later")
+			return
+		}
+		if err = guard.CheckMX(r.Context(), email); err != nil {
+			util.UserError(w, err.Error())
+			return
+		}
+
 		alreadySubbed := false
-		if err = ds.SubscribeToMailingList(listID, email); err != nil {
+		if err = ds.SubscribeToMailingList(listID, email, firstName, lastName, fields); err != nil {
 			if datastore.IsUniqueConstraintError(err) {
 				alreadySubbed = true
 			} else {
@@ -247,43 +391,12 @@ func serveSubscribe(ds datastore.Datastore) http.HandlerFunc {
 	})
 }
 
-func serveUnsubscribe(ds datastore.Datastore) http.HandlerFunc {
+// serveSubscribeToken hands out the token a subscribe form submits, to show
+// how long it was open for.
+func serveSubscribeToken(guard *mailer.SignupGuard) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		listName := chi.URLParam(r, "listName")
-		email := chi.URLParam(r, "email")
-		unsubToken := chi.URLParam(r, "unsubToken")
-		listID, err := ds.GetMailingListID(listName)
-		if err != nil {
-			util.ServerError(w, err)
-			return
-		}
-		if listID == datastore.MailingListNoExist {
-			util.UserError(w, fmt.Sprintf("Provided invalid mailing list: %s", listName))
-			return
-		}
-		log.Info().Msgf("Unsubscribing %s from list %d", email, listID)
-		if err = ds.UnsubscribeRequest(listID, email, unsubToken); err != nil {
-			if err == sql.ErrNoRows {
-				util.NotFound(w, fmt.Sprintf("Email %s not found on list %s", email, listName))
-				return
-			} else if err == datastore.ErrorBadToken {
-				util.Forbidden(w, "Bad token provided")
-				return
-			}
-		}
-		pageData := TimedMessagePageData{Title: "Unsubscribe", Message: "You have been unsubscribed."}
-		tmpl, err := util.NewTemplate("timed_message.html")
-		if err != nil {
-			util.ServerError(w, err)
-			return
-		}
-		if err = tmpl.Execute(w, &pageData); err != nil {
-			util.ServerError(w, err)
-			return
-		}
-
-		// CORS
 		w.Header().Set("Access-Control-Allow-Origin", "*")
+		util.WriteJSON(w, map[string]string{"token": guard.FormToken()})
 	})
 }
 
@@ -291,9 +404,27 @@ type DisplayListInfo struct {
 	ListName        string
 	Subscribers     []datastore.SubscriberInfo
 	HasPendingBlast bool
+	PendingBlasts   []BlastView
+	GracePeriod     string
+	// ListGracePeriod is empty when the list uses the global default
+	ListGracePeriod string
+	Drafts          []datastore.Draft
+	PublicArchive   bool
+	// Draft is opened in the draft modal when the page loads
+	Draft      *datastore.Draft
+	Fields     []datastore.ListField
+	FieldTypes []datastore.FieldType
+	Segments   []SegmentView
+	Tags       []string
+	// OtherLists can be sent the same blast, once to anyone on several lists
+	OtherLists []string
+	Churn      datastore.ListChurn
 }
 
-func serveDisplayList(ds datastore.Datastore, mc *mailer.MailCanceller) http.HandlerFunc {
+// churnDays is how far back the list page looks for recent churn.
+const churnDays = 30
+
+func serveDisplayList(ds datastore.Datastore, scheduler *mailer.Scheduler) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		listName := chi.URLParam(r, "listName")
 		listID, err := ds.GetMailingListID(listName)
@@ -311,10 +442,95 @@ func serveDisplayList(ds datastore.Datastore, mc *mailer.MailCanceller) http.Han
 			util.ServerError(w, err)
 			return
 		}
+		blasts, err := ds.QueryListBlastsByStatus(listID, datastore.BlastScheduled, datastore.BlastPaused, datastore.BlastSending)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		pending, err := blastViews(ds, blasts)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		gracePeriod, err := scheduler.GracePeriod(listID)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		listGracePeriod, hasListGracePeriod, err := ds.GetListGracePeriod(listID)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		drafts, err := ds.QueryListDrafts(listID)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		draft, err := loadListDraft(ds, r.URL.Query().Get("draft"), listID)
+		if err != nil {
+			draftError(w, err)
+			return
+		}
+		publicArchive, err := ds.IsListArchivePublic(listID)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		fields, err := ds.QueryListFields(listID)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		segments, err := ds.QueryListSegments(listID)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		segmentList, err := segmentViews(ds, segments, listID)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		tags, err := ds.QueryListTags(listID)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		churn, err := ds.QueryListChurn(listID, churnDays)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		lists, err := ds.QueryAllMailingLists()
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		var otherLists []string
+		for _, list := range lists {
+			if list.Name != listName {
+				otherLists = append(otherLists, list.Name)
+			}
+		}
 		pageData := DisplayListInfo{
 			ListName:        listName,
 			Subscribers:     subs,
-			HasPendingBlast: mc.ListHasContext(listName),
+			HasPendingBlast: len(pending) > 0,
+			PendingBlasts:   pending,
+			GracePeriod:     gracePeriod.String(),
+			Drafts:          drafts,
+			PublicArchive:   publicArchive,
+			Draft:           draft,
+			Fields:          fields,
+			FieldTypes:      datastore.FieldTypes,
+			Segments:        segmentList,
+			Tags:            tags,
+			OtherLists:      otherLists,
+			Churn:           churn,
+		}
+		if hasListGracePeriod {
+			pageData.ListGracePeriod = listGracePeriod.String()
 		}
 		tmpl, err := util.NewTemplate("list.html")
 		if err != nil {
@@ -350,17 +566,91 @@ func serveCreateList(ds datastore.Datastore) http.HandlerFunc {
 	})
 }
 
-func serveCancelList(logger *zerolog.Logger, mc *mailer.MailCanceller) http.HandlerFunc {
+func serveSetGracePeriod(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listName := chi.URLParam(r, "listName")
+		err := r.ParseForm()
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		listID, err := ds.GetMailingListID(listName)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if listID == datastore.MailingListNoExist {
+			util.UserError(w, fmt.Sprintf("Provided invalid mailing list: %s", listName))
+			return
+		}
+
+		// An empty value puts the list back on the global default
+		raw := util.FormValue(r, "grace_period")
+		if raw == "" {
+			err = ds.ClearListGracePeriod(listID)
+		} else {
+			gracePeriod, parseErr := time.ParseDuration(raw)
+			if parseErr != nil || gracePeriod < 0 {
+				util.UserError(w, fmt.Sprintf("Provided invalid grace period: %s", raw))
+				return
+			}
+			err = ds.SetListGracePeriod(listID, gracePeriod)
+		}
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		redirectLink := filepath.Join("/admin/list/display/", listName)
+		http.Redirect(w, r, redirectLink, http.StatusSeeOther)
+	})
+}
+
+func serveCancelList(logger *zerolog.Logger, ds datastore.Datastore, scheduler *mailer.Scheduler) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		listName := chi.URLParam(r, "listName")
+		listID, err := ds.GetMailingListID(listName)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if listID == datastore.MailingListNoExist {
+			util.UserError(w, fmt.Sprintf("Provided invalid mailing list: %s", listName))
+			return
+		}
 		logger.Info().Msgf("Sending cancel for list %s", listName)
-		mc.CancelMailingList(listName)
+		if err = scheduler.CancelList(listID); err != nil {
+			util.ServerError(w, err)
+			return
+		}
 		redirectLink := filepath.Join("/admin/list/display/", listName)
 		http.Redirect(w, r, redirectLink, http.StatusSeeOther)
 	})
 }
 
-func serveEnqueueMail(logger *zerolog.Logger, ds datastore.Datastore, mc *mailer.MailCanceller, limiter *rate.Limiter) http.HandlerFunc {
+// blastListIDs looks up the other lists a blast is also sent to, by name,
+// returning them after the blast's own list.
+func blastListIDs(ds datastore.Datastore, listID int, otherLists []string) ([]int, error) {
+	listIDs := []int{listID}
+	for _, name := range otherLists {
+		otherID, err := ds.GetMailingListID(name)
+		if err != nil {
+			return nil, err
+		}
+		if otherID == datastore.MailingListNoExist {
+			return nil, errors.New(fmt.Sprintf("Provided invalid mailing list: %s", name))
+		}
+		duplicate := false
+		for _, id := range listIDs {
+			duplicate = duplicate || id == otherID
+		}
+		if !duplicate {
+			listIDs = append(listIDs, otherID)
+		}
+	}
+	return listIDs, nil
+}
+
+func serveEnqueueMail(logger *zerolog.Logger, ds datastore.Datastore, scheduler *mailer.Scheduler) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		err := r.ParseForm()
 		if err != nil {
@@ -383,42 +673,76 @@ func serveEnqueueMail(logger *zerolog.Logger, ds datastore.Datastore, mc *mailer
 			util.UserError(w, fmt.Sprintf("Provided invalid mailing list: %s", listName))
 			return
 		}
-		subscribers, err := ds.QueryMailingListSubscriberInfo(listID)
+		gracePeriod, err := scheduler.GracePeriod(listID)
 		if err != nil {
 			util.ServerError(w, err)
 			return
 		}
-		mxDomain, err := util.GetenvOrError("MX_DOMAIN")
+		sendAt, err := parseSendAt(r, time.Now().Add(gracePeriod))
+		if err != nil {
+			util.UserError(w, err.Error())
+			return
+		}
+		listIDs, err := blastListIDs(ds, listID, r.Form["also_list"])
+		if err != nil {
+			util.UserError(w, err.Error())
+			return
+		}
+		// Catch bad merge tags and missing configuration now rather than when the blast goes out
+		sample, err := sampleMergeData(ds, listName, listIDs...)
 		if err != nil {
 			util.ServerError(w, err)
 			return
 		}
-		normalizedListName := util.ReplaceWhitespaceWith(listName, "-")
-		fromEmail := fmt.Sprintf("chillmailer-%s@%s", normalizedListName, mxDomain)
-		if !util.IsEmailValid(fromEmail) {
-			util.ServerError(w, errors.New(fmt.Sprintf("Bad email: %s", fromEmail)))
+		if _, err = mailer.ParseMergeTags(subject, body, sample); err != nil {
+			util.UserError(w, err.Error())
+			return
+		}
+		if _, err = mailer.NewTransportFromEnv(); err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if _, err = mailer.FromAddressForList(listName); err != nil {
+			util.ServerError(w, err)
 			return
 		}
 
-		webRoot := util.GetWebRoot(r)
-		go func() {
-			cancelCtx := mc.ContextForMailingList(listName)
-			select {
-			case <-time.After(30 * time.Second):
-				rateCtx := context.Background()
-				for _, sub := range subscribers {
-					limiter.Wait(rateCtx)
-					unsubscribeLink := webRoot + filepath.Join("/unsubscribe", listName, sub.Email, sub.UnsubToken)
-					if err = mailer.SendMail(fromEmail, sub.Email, subject, body, unsubscribeLink); err != nil {
-						logger.Error().Err(err)
-					} else {
-						logger.Info().Msgf("Successfully sent email to %s", sub.Email)
-					}
-				}
-			case <-cancelCtx.Done():
-				logger.Info().Msgf("Emails to list %s have been cancelled", listName)
+		segment, err := loadListSegment(ds, util.FormValue(r, "segment"), listID)
+		if err != nil {
+			segmentError(w, err)
+			return
+		}
+		segmentID := 0
+		if segment != nil {
+			if len(listIDs) > 1 {
+				util.UserError(w, "Segments can only be sent to on their own list")
+				return
+			}
+			if _, err = segmentFilter(ds, segment, listID); err != nil {
+				util.UserError(w, err.Error())
+				return
 			}
-		}()
+			segmentID = segment.ID
+		}
+
+		draft, err := loadListDraft(ds, util.FormValue(r, "draft_id"), listID)
+		if err != nil {
+			draftError(w, err)
+			return
+		}
+
+		blastID, err := scheduler.Enqueue(listIDs, segmentID, subject, body, util.GetWebRoot(r), adminUser(r), sendAt)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		// The draft lives on in the archive once the blast is sent
+		if draft != nil {
+			if err = ds.DeleteDraft(draft.ID); err != nil {
+				logger.Error().Err(err).Msgf("Could not delete draft %d", draft.ID)
+			}
+		}
+		logger.Info().Msgf("Scheduled blast %d to list %s for %s", blastID, listName, sendAt)
 		redirectLink := filepath.Join("/admin/list/display/", listName)
 		http.Redirect(w, r, redirectLink, http.StatusSeeOther)
 	})
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/keur/chillmailer/datastore"
+	"github.com/keur/chillmailer/mailer"
+	"github.com/keur/chillmailer/util"
+	"github.com/rs/zerolog/log"
+)
+
+// maxPauseWeeks is the longest subscribers can pause their mail for.
+const maxPauseWeeks = 52
+
+// preferenceMessages confirm what was just changed, by the updated query parameter.
+var preferenceMessages = map[string]string{
+	"lists":      "Your lists have been updated.",
+	"paused":     "Your mail has been paused.",
+	"resumed":    "Your mail has been resumed.",
+	"fields":     "Your details have been saved.",
+	"email_sent": "We sent a link to your new address. Your subscriptions move over once you follow it.",
+	"email":      "Your address has been changed.",
+}
+
+// unsubscribedFromPreferences is the reason kept for lists unchecked on the
+// preferences page.
+const unsubscribedFromPreferences = "Unchecked on the preferences page"
+
+// PreferenceList is a list the subscriber is on, or has left, with the fields
+// they can edit.
+type PreferenceList struct {
+	datastore.Subscription
+	ListFields []datastore.ListField
+}
+
+type PreferencesPageData struct {
+	Token string
+	Email string
+	Lists []PreferenceList
+	// PausedUntil is zero unless mail is paused
+	PausedUntil   time.Time
+	MaxPauseWeeks int
+	Message       string
+}
+
+// preferencesEmail checks the signed token in the link, returning the address
+// it was sent to.
+func preferencesEmail(w http.ResponseWriter, r *http.Request, preferences *mailer.PreferenceSigner) (string, bool) {
+	email, ok := preferences.Verify(chi.URLParam(r, "token"))
+	if !ok {
+		util.Forbidden(w, "This link is invalid. Use the one from your most recent email.")
+		return "", false
+	}
+	return email, true
+}
+
+func preferencesLink(r *http.Request, updated string) string {
+	return "/preferences/" + chi.URLParam(r, "token") + "?updated=" + updated
+}
+
+func servePreferences(ds datastore.Datastore, preferences *mailer.PreferenceSigner) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		email, ok := preferencesEmail(w, r, preferences)
+		if !ok {
+			return
+		}
+		subscriptions, err := ds.QueryEmailSubscriptions(email)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+
+		pageData := PreferencesPageData{
+			Token:         chi.URLParam(r, "token"),
+			Email:         email,
+			MaxPauseWeeks: maxPauseWeeks,
+			Message:       preferenceMessages[r.URL.Query().Get("updated")],
+		}
+		for _, sub := range subscriptions {
+			fields, err := ds.QueryListFields(sub.ListID)
+			if err != nil {
+				util.ServerError(w, err)
+				return
+			}
+			pageData.Lists = append(pageData.Lists, PreferenceList{Subscription: sub, ListFields: fields})
+			if !sub.IsUnsubscribed() && sub.PausedUntil.After(time.Now()) && sub.PausedUntil.After(pageData.PausedUntil) {
+				pageData.PausedUntil = sub.PausedUntil
+			}
+		}
+
+		tmpl, err := util.NewTemplate("preferences.html")
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if err = tmpl.Execute(w, &pageData); err != nil {
+			util.ServerError(w, err)
+		}
+	})
+}
+
+// serveUpdatePreferenceLists unsubscribes from every list left unchecked, and
+// resubscribes to those checked again.
+func serveUpdatePreferenceLists(ds datastore.Datastore, preferences *mailer.PreferenceSigner) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		email, ok := preferencesEmail(w, r, preferences)
+		if !ok {
+			return
+		}
+		err := r.ParseForm()
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		subscriptions, err := ds.QueryEmailSubscriptions(email)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		keep := make(map[string]bool)
+		for _, listName := range r.Form["list"] {
+			keep[listName] = true
+		}
+		for _, sub := range subscriptions {
+			switch {
+			case keep[sub.ListName] && sub.IsUnsubscribed():
+				var suppressed bool
+				if suppressed, err = ds.IsSuppressed(sub.Email); err != nil {
+					util.ServerError(w, err)
+					return
+				}
+				if suppressed {
+					util.UserError(w, fmt.Sprintf("%s can no longer be subscribed", sub.Email))
+					return
+				}
+				log.Info().Msgf("Resubscribing %s to list %d", sub.Email, sub.ListID)
+				err = ds.Resubscribe(sub.ListID, sub.Email)
+			case !keep[sub.ListName] && !sub.IsUnsubscribed():
+				log.Info().Msgf("Unsubscribing %s from list %d", sub.Email, sub.ListID)
+				err = ds.Unsubscribe(sub.ListID, sub.Email, unsubscribedFromPreferences)
+			}
+			if err != nil {
+				util.ServerError(w, err)
+				return
+			}
+		}
+		http.Redirect(w, r, preferencesLink(r, "lists"), http.StatusSeeOther)
+	})
+}
+
+// servePauseSubscriptions holds mail on every list for some weeks, or
+// resumes it when given none.
+func servePauseSubscriptions(ds datastore.Datastore, preferences *mailer.PreferenceSigner) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		email, ok := preferencesEmail(w, r, preferences)
+		if !ok {
+			return
+		}
+		err := r.ParseForm()
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		weeks, err := strconv.Atoi(util.FormValue(r, "weeks"))
+		if err != nil || weeks < 0 || weeks > maxPauseWeeks {
+			util.UserError(w, fmt.Sprintf("Mail can be paused for 1 to %d weeks", maxPauseWeeks))
+			return
+		}
+
+		var until time.Time
+		updated := "resumed"
+		if weeks > 0 {
+			until, updated = time.Now().AddDate(0, 0, 7*weeks), "paused"
+		}
+		if err = ds.PauseSubscriptions(email, until); err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		http.Redirect(w, r, preferencesLink(r, updated), http.StatusSeeOther)
+	})
+}
+
+// serveChangeEmail sends a confirmation link to the new address. Nothing
+// moves over until it is followed.
+func serveChangeEmail(ds datastore.Datastore, preferences *mailer.PreferenceSigner) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		email, ok := preferencesEmail(w, r, preferences)
+		if !ok {
+			return
+		}
+		err := r.ParseForm()
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		newEmail := util.FormValue(r, "new_email")
+		if html.EscapeString(newEmail) != newEmail || !util.IsEmailValid(newEmail) {
+			util.UserError(w, fmt.Sprintf("Provided invalid email: %s", newEmail))
+			return
+		}
+		if util.NormalizeEmail(newEmail) == util.NormalizeEmail(email) {
+			util.UserError(w, "That is already your address")
+			return
+		}
+		suppressed, err := ds.IsSuppressed(newEmail)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if suppressed {
+			util.UserError(w, fmt.Sprintf("%s can no longer be subscribed", newEmail))
+			return
+		}
+		subscriptions, err := ds.QueryEmailSubscriptions(email)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if len(subscriptions) == 0 {
+			util.UserError(w, "You are not on any lists")
+			return
+		}
+		fromEmail, err := mailer.FromAddressForList(subscriptions[0].ListName)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+
+		changeToken, err := ds.CreateEmailChange(email, newEmail)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		confirmLink := util.GetWebRoot(r) + "/preferences/confirm/" + changeToken
+		err = mailer.SendMail(mailer.Email{
+			From:    fromEmail,
+			To:      newEmail,
+			Subject: "Confirm your new address",
+			Body: fmt.Sprintf("Someone asked to move the subscriptions of %s to this address. [Confirm the change](%s) within %d hours to finish.\n\nIf it wasn't you, ignore this message and nothing will change.",
+				email, confirmLink, int(datastore.EmailChangeExpiry.Hours())),
+		})
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		http.Redirect(w, r, preferencesLink(r, "email_sent"), http.StatusSeeOther)
+	})
+}
+
+func serveConfirmEmailChange(ds datastore.Datastore, preferences *mailer.PreferenceSigner) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		newEmail, err := ds.ConfirmEmailChange(chi.URLParam(r, "changeToken"))
+		if err == sql.ErrNoRows {
+			util.NotFound(w, "This link has expired or was already used")
+			return
+		} else if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		http.Redirect(w, r, preferences.Link("", newEmail)+"?updated=email", http.StatusSeeOther)
+	})
+}
+
+// serveUpdatePreferenceFields saves the custom fields of one of the subscriber's lists.
+func serveUpdatePreferenceFields(ds datastore.Datastore, preferences *mailer.PreferenceSigner) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		email, ok := preferencesEmail(w, r, preferences)
+		if !ok {
+			return
+		}
+		err := r.ParseForm()
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		subscriptions, err := ds.QueryEmailSubscriptions(email)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		listName := chi.URLParam(r, "listName")
+		var sub *datastore.Subscription
+		for i := range subscriptions {
+			if subscriptions[i].ListName == listName && !subscriptions[i].IsUnsubscribed() {
+				sub = &subscriptions[i]
+			}
+		}
+		if sub == nil {
+			util.NotFound(w, fmt.Sprintf("You are not on list %s", listName))
+			return
+		}
+		fields, err := ds.QueryListFields(sub.ListID)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		values, err := parseSubscriberFields(r, fields)
+		if err != nil {
+			util.UserError(w, err.Error())
+			return
+		}
+		if err = ds.UpdateSubscriberFields(sub.ListID, sub.Email, values); err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		http.Redirect(w, r, preferencesLink(r, "fields"), http.StatusSeeOther)
+	})
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+
+	"github.com/keur/chillmailer/datastore"
+	"github.com/keur/chillmailer/mailer"
+	"github.com/keur/chillmailer/util"
+	"github.com/rs/zerolog"
+)
+
+// testUnsubToken stands in for the unsubscribe token in test messages, so the
+// link in them can't unsubscribe anyone.
+const testUnsubToken = "test-message"
+
+// sampleSubscriberEmail is who we preview a draft for when its list is empty.
+const sampleSubscriberEmail = "subscriber@example.com"
+
+// draftForm is a draft blast as posted from the draft modal.
+type draftForm struct {
+	ListName string
+	ListID   int
+	Subject  string
+	Body     string
+	Merge    *mailer.MergeTemplate
+}
+
+// parseDraftForm reads a draft, writing the error response itself on failure.
+func parseDraftForm(w http.ResponseWriter, r *http.Request, ds datastore.Datastore) (draftForm, bool) {
+	if err := r.ParseForm(); err != nil {
+		util.ServerError(w, err)
+		return draftForm{}, false
+	}
+	draft := draftForm{
+		ListName: util.FormValue(r, "list_name"),
+		Subject:  util.FormValue(r, "subject"),
+		Body:     util.FormValue(r, "body"),
+	}
+	if draft.ListName == "" || draft.Subject == "" || draft.Body == "" {
+		util.UserError(w, "Provided invalid form data")
+		return draft, false
+	}
+	listID, err := ds.GetMailingListID(draft.ListName)
+	if err != nil {
+		util.ServerError(w, err)
+		return draft, false
+	}
+	if listID == datastore.MailingListNoExist {
+		util.UserError(w, fmt.Sprintf("Provided invalid mailing list: %s", draft.ListName))
+		return draft, false
+	}
+	draft.ListID = listID
+	sample, err := sampleMergeData(ds, draft.ListName, listID)
+	if err != nil {
+		util.ServerError(w, err)
+		return draft, false
+	}
+	if draft.Merge, err = mailer.ParseMergeTags(draft.Subject, draft.Body, sample); err != nil {
+		util.UserError(w, err.Error())
+		return draft, false
+	}
+	return draft, true
+}
+
+// sampleSubscriber picks the list's first subscriber to fill in a preview.
+// Their real unsubscribe token is swapped out, so the preview's links can't
+// act on them.
+func sampleSubscriber(ds datastore.Datastore, listID int) (datastore.SubscriberInfo, error) {
+	subscribers, err := ds.QueryMailingListSubscriberInfo(listID)
+	if err != nil {
+		return datastore.SubscriberInfo{}, err
+	}
+	if len(subscribers) == 0 {
+		return datastore.SubscriberInfo{Email: sampleSubscriberEmail, UnsubToken: testUnsubToken}, nil
+	}
+	subscriber := subscribers[0]
+	subscriber.UnsubToken = testUnsubToken
+	return subscriber, nil
+}
+
+type PreviewMailData struct {
+	ListName string
+	Subject  string
+	Body     string
+	// Recipient is the sample subscriber the preview was rendered for
+	Recipient string
+	Message   *mailer.Message
+}
+
+// servePreviewMail shows a draft as its list's first subscriber would get it,
+// leaving out the preferences link, which would let anyone viewing it manage
+// their subscriptions.
+func servePreviewMail(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		draft, ok := parseDraftForm(w, r, ds)
+		if !ok {
+			return
+		}
+		fromEmail, err := mailer.FromAddressForList(draft.ListName)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		subscriber, err := sampleSubscriber(ds, draft.ListID)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		layout, err := mailer.ListLayout(ds, draft.ListID)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+
+		subject, body, err := draft.Merge.Render(mailer.SubscriberMergeData(draft.ListName, subscriber))
+		if err != nil {
+			util.UserError(w, err.Error())
+			return
+		}
+		unsubscribeLink := mailer.UnsubscribeLink(util.GetWebRoot(r), draft.ListName, subscriber.Email, subscriber.UnsubToken, 0)
+		message, err := mailer.RenderMessage(mailer.Email{
+			From:            fromEmail,
+			To:              subscriber.Email,
+			Subject:         subject,
+			Body:            body,
+			UnsubscribeLink: unsubscribeLink,
+			Layout:          layout,
+		})
+		if err != nil {
+			util.UserError(w, fmt.Sprintf("Could not render message: %s", err))
+			return
+		}
+
+		pageData := PreviewMailData{
+			ListName:  draft.ListName,
+			Subject:   draft.Subject,
+			Body:      draft.Body,
+			Recipient: subscriber.Email,
+			Message:   message,
+		}
+		tmpl, err := util.NewTemplate("preview.html")
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if err = tmpl.Execute(w, &pageData); err != nil {
+			util.ServerError(w, err)
+			return
+		}
+	})
+}
+
+// serveSendTestMail sends a draft to one address, outside of any blast. The
+// list is only used for its from address, and no delivery is recorded.
+func serveSendTestMail(logger *zerolog.Logger, ds datastore.Datastore, preferences *mailer.PreferenceSigner) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		draft, ok := parseDraftForm(w, r, ds)
+		if !ok {
+			return
+		}
+		testEmail := util.FormValue(r, "test_email")
+		if !util.IsEmailValid(testEmail) {
+			util.UserError(w, fmt.Sprintf("Provided invalid email: %s", testEmail))
+			return
+		}
+		transport, err := mailer.NewTransportFromEnv()
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		fromEmail, err := mailer.FromAddressForList(draft.ListName)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		layout, err := mailer.ListLayout(ds, draft.ListID)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+
+		// Fill in merge tags as the test address's own subscription would, if it has one
+		subscriber, err := ds.GetSubscriber(draft.ListID, testEmail)
+		if err == sql.ErrNoRows {
+			subscriber, err = datastore.SubscriberInfo{Email: testEmail}, nil
+		}
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		subject, body, err := draft.Merge.Render(mailer.SubscriberMergeData(draft.ListName, subscriber))
+		if err != nil {
+			util.UserError(w, err.Error())
+			return
+		}
+
+		unsubscribeLink := mailer.UnsubscribeLink(util.GetWebRoot(r), draft.ListName, testEmail, testUnsubToken, 0)
+		err = transport.SendMail(mailer.Email{
+			From:            fromEmail,
+			To:              testEmail,
+			Subject:         "[Test] " + subject,
+			Body:            body,
+			UnsubscribeLink: unsubscribeLink,
+			PreferencesLink: preferences.Link(util.GetWebRoot(r), testEmail),
+			Layout:          layout,
+		})
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		logger.Info().Msgf("Sent test message for list %s to %s", draft.ListName, testEmail)
+
+		pageData := TimedMessagePageData{Title: "Test Sent", Message: fmt.Sprintf("Sent a test message to %s.", testEmail)}
+		tmpl, err := util.NewTemplate("timed_message.html")
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if err = tmpl.Execute(w, &pageData); err != nil {
+			util.ServerError(w, err)
+			return
+		}
+	})
+}
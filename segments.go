@@ -0,0 +1,260 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/keur/chillmailer/datastore"
+	"github.com/keur/chillmailer/util"
+)
+
+// loadListSegment looks up a segment by the ID given in a form, making sure it
+// belongs to the list. An empty ID means the whole list and returns nil.
+func loadListSegment(ds datastore.Datastore, raw string, listID int) (*datastore.Segment, error) {
+	if raw == "" || raw == "0" {
+		return nil, nil
+	}
+	segmentID, err := strconv.Atoi(raw)
+	if err != nil {
+		return nil, sql.ErrNoRows
+	}
+	segment, err := ds.GetSegment(segmentID)
+	if err != nil {
+		return nil, err
+	}
+	if segment.ListID != listID {
+		return nil, sql.ErrNoRows
+	}
+	return &segment, nil
+}
+
+func segmentError(w http.ResponseWriter, err error) {
+	if err == sql.ErrNoRows {
+		util.NotFound(w, "Segment not found")
+	} else {
+		util.ServerError(w, err)
+	}
+}
+
+// segmentFilter is who a blast to the segment would go to. A nil segment is the whole list.
+func segmentFilter(ds datastore.Datastore, segment *datastore.Segment, listID int) (datastore.SubscriberFilter, error) {
+	if segment == nil {
+		return datastore.SubscriberFilter{}, nil
+	}
+	fields, err := ds.QueryListFields(listID)
+	if err != nil {
+		return datastore.SubscriberFilter{}, err
+	}
+	return segment.Rules.Filter(fields)
+}
+
+// SegmentView is a segment along with how many subscribers it matches now.
+type SegmentView struct {
+	datastore.Segment
+	Count int
+	// Error explains why the segment no longer works, such as a deleted field
+	Error string
+}
+
+func segmentViews(ds datastore.Datastore, segments []datastore.Segment, listID int) ([]SegmentView, error) {
+	views := make([]SegmentView, len(segments))
+	for i := range segments {
+		views[i].Segment = segments[i]
+		filter, err := segmentFilter(ds, &segments[i], listID)
+		if err != nil {
+			views[i].Error = err.Error()
+			continue
+		}
+		if views[i].Count, err = ds.CountListSubscribers(listID, filter); err != nil {
+			return nil, err
+		}
+	}
+	return views, nil
+}
+
+// parseSegmentRules reads the segment form on the list page.
+func parseSegmentRules(r *http.Request) (datastore.SegmentRules, error) {
+	var rules datastore.SegmentRules
+	var err error
+	if rules.IncludeTags, err = datastore.ParseTags(util.FormValue(r, "include_tags")); err != nil {
+		return rules, err
+	}
+	if rules.ExcludeTags, err = datastore.ParseTags(util.FormValue(r, "exclude_tags")); err != nil {
+		return rules, err
+	}
+	rules.JoinedAfter = util.FormValue(r, "joined_after")
+	rules.JoinedBefore = util.FormValue(r, "joined_before")
+	rules.Fields = strings.TrimSpace(util.FormValue(r, "fields"))
+	for _, days := range []struct {
+		name  string
+		value *int
+	}{{"active_days", &rules.ActiveDays}, {"inactive_days", &rules.InactiveDays}} {
+		raw := util.FormValue(r, days.name)
+		if raw == "" {
+			continue
+		}
+		if *days.value, err = strconv.Atoi(raw); err != nil {
+			return rules, errors.New(fmt.Sprintf("Invalid number of days: %s", raw))
+		}
+	}
+	return rules, nil
+}
+
+func serveCreateSegment(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listName := chi.URLParam(r, "listName")
+		err := r.ParseForm()
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		listID, err := ds.GetMailingListID(listName)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if listID == datastore.MailingListNoExist {
+			util.UserError(w, fmt.Sprintf("Provided invalid mailing list: %s", listName))
+			return
+		}
+
+		name := util.FormValue(r, "name")
+		if name == "" || len(name) > maxNameLength {
+			util.UserError(w, "Provided invalid segment name")
+			return
+		}
+		rules, err := parseSegmentRules(r)
+		if err != nil {
+			util.UserError(w, err.Error())
+			return
+		}
+		fields, err := ds.QueryListFields(listID)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if _, err = rules.Filter(fields); err != nil {
+			util.UserError(w, err.Error())
+			return
+		}
+		if _, err = ds.CreateSegment(listID, name, rules); err != nil {
+			if datastore.IsUniqueConstraintError(err) {
+				util.UserError(w, fmt.Sprintf("List %s already has a segment named %s", listName, name))
+			} else {
+				util.ServerError(w, err)
+			}
+			return
+		}
+		http.Redirect(w, r, listDisplayLink(listName), http.StatusSeeOther)
+	})
+}
+
+func serveDeleteSegment(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listName := chi.URLParam(r, "listName")
+		listID, err := ds.GetMailingListID(listName)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		segment, err := loadListSegment(ds, chi.URLParam(r, "segmentID"), listID)
+		if err != nil || segment == nil {
+			segmentError(w, sql.ErrNoRows)
+			return
+		}
+		if err = ds.DeleteSegment(segment.ID); err == datastore.ErrSegmentInUse {
+			util.UserError(w, err.Error())
+			return
+		} else if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		http.Redirect(w, r, listDisplayLink(listName), http.StatusSeeOther)
+	})
+}
+
+type RecipientCountData struct {
+	Count int `json:"count"`
+}
+
+// serveRecipientCount tells the draft modal how many subscribers a blast to
+// the chosen segment or lists would go to right now.
+func serveRecipientCount(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listName := chi.URLParam(r, "listName")
+		listID, err := ds.GetMailingListID(listName)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if listID == datastore.MailingListNoExist {
+			util.NotFound(w, fmt.Sprintf("Provided invalid mailing list: %s", listName))
+			return
+		}
+		segment, err := loadListSegment(ds, r.URL.Query().Get("segment"), listID)
+		if err != nil {
+			segmentError(w, err)
+			return
+		}
+		filter, err := segmentFilter(ds, segment, listID)
+		if err != nil {
+			util.UserError(w, err.Error())
+			return
+		}
+		listIDs, err := blastListIDs(ds, listID, r.URL.Query()["also_list"])
+		if err != nil {
+			util.UserError(w, err.Error())
+			return
+		}
+		if segment != nil && len(listIDs) > 1 {
+			util.UserError(w, "Segments can only be sent to on their own list")
+			return
+		}
+		count, err := ds.CountRecipients(listIDs, filter)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		util.WriteJSON(w, RecipientCountData{Count: count})
+	})
+}
+
+func serveUpdateSubscriberTags(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listName := chi.URLParam(r, "listName")
+		err := r.ParseForm()
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		listID, err := ds.GetMailingListID(listName)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if listID == datastore.MailingListNoExist {
+			util.UserError(w, fmt.Sprintf("Provided invalid mailing list: %s", listName))
+			return
+		}
+		tags, err := datastore.ParseTags(util.FormValue(r, "tags"))
+		if err != nil {
+			util.UserError(w, err.Error())
+			return
+		}
+
+		err = ds.SetSubscriberTags(listID, util.FormValue(r, "email"), tags)
+		if err == sql.ErrNoRows {
+			util.NotFound(w, "Subscriber not found")
+			return
+		} else if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		http.Redirect(w, r, listDisplayLink(listName), http.StatusSeeOther)
+	})
+}
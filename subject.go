@@ -0,0 +1,155 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"net/url"
+
+	"github.com/keur/chillmailer/datastore"
+	"github.com/keur/chillmailer/util"
+	"github.com/rs/zerolog/log"
+)
+
+// SubjectDataResponse is everything we hold about an address, as the API
+// shows it. Unsubscribe tokens are left out, as in exports.
+type SubjectDataResponse struct {
+	Email         string                         `json:"email"`
+	Subscriptions []ExportedSubscriberData       `json:"subscriptions"`
+	Deliveries    []datastore.SubjectDelivery    `json:"deliveries"`
+	Suppressions  []datastore.Suppression        `json:"suppressions"`
+	ImportRows    []datastore.SubjectImportRow   `json:"import_rejections"`
+	EmailChanges  []datastore.SubjectEmailChange `json:"email_changes"`
+}
+
+func newSubjectDataResponse(data datastore.SubjectData) SubjectDataResponse {
+	res := SubjectDataResponse{
+		Email:         data.Email,
+		Subscriptions: make([]ExportedSubscriberData, len(data.Subscriptions)),
+		Deliveries:    data.Deliveries,
+		Suppressions:  data.Suppressions,
+		ImportRows:    data.ImportRows,
+		EmailChanges:  data.EmailChanges,
+	}
+	for i, sub := range data.Subscriptions {
+		res.Subscriptions[i] = ExportedSubscriberData{
+			List: sub.ListName,
+			SubscriberData: SubscriberData{
+				Email:      sub.Email,
+				FirstName:  sub.FirstName,
+				LastName:   sub.LastName,
+				TimeJoined: sub.TimeJoined,
+				Fields:     sub.Fields,
+				Tags:       sub.Tags,
+			},
+			Status: sub.Status,
+		}
+	}
+	return res
+}
+
+// subjectEmail reads the address a data subject request is about.
+func subjectEmail(w http.ResponseWriter, r *http.Request) (string, bool) {
+	email := util.FormValue(r, "email")
+	if email == "" || html.EscapeString(email) != email || !util.IsEmailValid(email) {
+		util.UserError(w, "Provided invalid email")
+		return "", false
+	}
+	return email, true
+}
+
+// eraseSubject forgets the address, logging only its hash.
+func eraseSubject(ds datastore.Datastore, email string) error {
+	if err := ds.EraseSubject(email); err != nil {
+		return err
+	}
+	log.Info().Msgf("Erased data subject %s", datastore.EmailHash(email))
+	return nil
+}
+
+func serveSubjectAPI(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		email, ok := subjectEmail(w, r)
+		if !ok {
+			return
+		}
+		data, err := ds.QuerySubjectData(email)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		util.WriteJSON(w, newSubjectDataResponse(data))
+	})
+}
+
+type SubjectErasedData struct {
+	Email     string `json:"email"`
+	Tombstone string `json:"tombstone"`
+}
+
+func serveEraseSubjectAPI(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		email, ok := subjectEmail(w, r)
+		if !ok {
+			return
+		}
+		if err := eraseSubject(ds, email); err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		util.WriteJSON(w, SubjectErasedData{Email: util.NormalizeEmail(email), Tombstone: datastore.EmailHash(email)})
+	})
+}
+
+type SubjectPageData struct {
+	Email string
+	Data  *datastore.SubjectData
+	// Erased is the tombstone of an address that was just erased
+	Erased string
+}
+
+// serveSubjectPage looks up an address for the admin, who can then erase it.
+func serveSubjectPage(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pageData := SubjectPageData{Email: util.FormValue(r, "email"), Erased: r.URL.Query().Get("erased")}
+		if pageData.Email != "" {
+			email, ok := subjectEmail(w, r)
+			if !ok {
+				return
+			}
+			data, err := ds.QuerySubjectData(email)
+			if err != nil {
+				util.ServerError(w, err)
+				return
+			}
+			pageData.Data = &data
+		}
+		tmpl, err := util.NewTemplate("subject.html")
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if err = tmpl.Execute(w, &pageData); err != nil {
+			util.ServerError(w, err)
+		}
+	})
+}
+
+func serveEraseSubject(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		email, ok := subjectEmail(w, r)
+		if !ok {
+			return
+		}
+		if err = eraseSubject(ds, email); err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		// The address itself stays out of the URL, and so out of browser history and logs
+		http.Redirect(w, r, "/admin/subject?erased="+url.QueryEscape(datastore.EmailHash(email)), http.StatusSeeOther)
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"html"
+	"net/http"
+
+	"github.com/keur/chillmailer/datastore"
+	"github.com/keur/chillmailer/util"
+)
+
+type SuppressionsPageData struct {
+	Suppressions []datastore.Suppression
+}
+
+func serveSuppressions(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		suppressions, err := ds.QuerySuppressions()
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		tmpl, err := util.NewTemplate("suppressions.html")
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if err = tmpl.Execute(w, &SuppressionsPageData{Suppressions: suppressions}); err != nil {
+			util.ServerError(w, err)
+		}
+	})
+}
+
+func serveAddSuppression(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		email := util.FormValue(r, "email")
+		if html.EscapeString(email) != email || !util.IsEmailValid(email) {
+			util.UserError(w, "Provided invalid email")
+			return
+		}
+		reason := util.FormValue(r, "reason")
+		if len(reason) > maxNameLength {
+			util.UserError(w, "Provided reason is too long")
+			return
+		}
+		if err = ds.AddSuppression(email, reason); err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		http.Redirect(w, r, "/admin/suppressions", http.StatusSeeOther)
+	})
+}
+
+func serveRemoveSuppression(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if err = ds.RemoveSuppression(util.FormValue(r, "email")); err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		http.Redirect(w, r, "/admin/suppressions", http.StatusSeeOther)
+	})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/keur/chillmailer/datastore"
+	"github.com/keur/chillmailer/util"
+	"github.com/rs/zerolog/log"
+)
+
+// unsubscribeReasons are offered on the unsubscribe page. Subscribers can
+// also type in their own.
+var unsubscribeReasons = []string{
+	"I get too many emails",
+	"The emails aren't relevant to me",
+	"I never signed up for this list",
+	"I only meant to sign up once",
+}
+
+// otherReason is the choice that uses the typed in reason instead.
+const otherReason = "other"
+
+// maxReasonLength caps the reason subscribers type in, in bytes.
+const maxReasonLength = 500
+
+// removedByAdmin is the reason kept for subscribers removed from the list page.
+const removedByAdmin = "Removed by an admin"
+
+type UnsubscribePageData struct {
+	ListName        string
+	Email           string
+	BlastID         int
+	Reasons         []string
+	OtherReason     string
+	MaxReasonLength int
+}
+
+// unsubscribeSubscription checks the list and token in an unsubscribe link,
+// returning the subscription it is for.
+func unsubscribeSubscription(w http.ResponseWriter, r *http.Request, ds datastore.Datastore) (int, datastore.SubscriberInfo, bool) {
+	listName := chi.URLParam(r, "listName")
+	email := chi.URLParam(r, "email")
+	listID, err := ds.GetMailingListID(listName)
+	if err != nil {
+		util.ServerError(w, err)
+		return 0, datastore.SubscriberInfo{}, false
+	}
+	if listID == datastore.MailingListNoExist {
+		util.UserError(w, fmt.Sprintf("Provided invalid mailing list: %s", listName))
+		return 0, datastore.SubscriberInfo{}, false
+	}
+	sub, err := ds.CheckUnsubscribeToken(listID, email, chi.URLParam(r, "unsubToken"))
+	if err == sql.ErrNoRows {
+		util.NotFound(w, fmt.Sprintf("Email %s not found on list %s", email, listName))
+		return 0, sub, false
+	} else if err == datastore.ErrorBadToken {
+		util.Forbidden(w, "Bad token provided")
+		return 0, sub, false
+	} else if err != nil {
+		util.ServerError(w, err)
+		return 0, sub, false
+	}
+	return listID, sub, true
+}
+
+func serveTimedMessage(w http.ResponseWriter, pageData TimedMessagePageData) {
+	tmpl, err := util.NewTemplate("timed_message.html")
+	if err != nil {
+		util.ServerError(w, err)
+		return
+	}
+	if err = tmpl.Execute(w, &pageData); err != nil {
+		util.ServerError(w, err)
+	}
+}
+
+// serveUnsubscribePage asks subscribers to confirm, and why they are leaving.
+// Following the link alone changes nothing, so link scanners can't unsubscribe
+// anyone.
+func serveUnsubscribePage(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, sub, ok := unsubscribeSubscription(w, r, ds)
+		if !ok {
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if sub.IsUnsubscribed() {
+			serveTimedMessage(w, TimedMessagePageData{Title: "Unsubscribe", Message: "You are already unsubscribed."})
+			return
+		}
+
+		// A link without a valid blast is still a link to unsubscribe
+		blastID, _ := strconv.Atoi(r.URL.Query().Get("blast"))
+		pageData := UnsubscribePageData{
+			ListName:        chi.URLParam(r, "listName"),
+			Email:           sub.Email,
+			BlastID:         blastID,
+			Reasons:         unsubscribeReasons,
+			OtherReason:     otherReason,
+			MaxReasonLength: maxReasonLength,
+		}
+		tmpl, err := util.NewTemplate("unsubscribe.html")
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if err = tmpl.Execute(w, &pageData); err != nil {
+			util.ServerError(w, err)
+		}
+	})
+}
+
+func serveUnsubscribe(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listID, sub, ok := unsubscribeSubscription(w, r, ds)
+		if !ok {
+			return
+		}
+		err := r.ParseForm()
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		reason := util.FormValue(r, "reason")
+		if reason == otherReason {
+			reason = util.FormValue(r, "other_reason")
+		}
+		if len(reason) > maxReasonLength {
+			util.UserError(w, "Provided reason is too long")
+			return
+		}
+		blastID, _ := strconv.Atoi(util.FormValue(r, "blast"))
+
+		log.Info().Msgf("Unsubscribing %s from list %d", sub.Email, listID)
+		err = ds.UnsubscribeRequest(listID, sub.Email, chi.URLParam(r, "unsubToken"), reason, blastID)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		serveTimedMessage(w, TimedMessagePageData{Title: "Unsubscribe", Message: "You have been unsubscribed."})
+	})
+}
+
+// serveRemoveSubscriber unsubscribes someone from the list page. Like any
+// unsubscribe, the subscription is kept for churn statistics.
+func serveRemoveSubscriber(ds datastore.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listName := chi.URLParam(r, "listName")
+		err := r.ParseForm()
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		listID, err := ds.GetMailingListID(listName)
+		if err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		if listID == datastore.MailingListNoExist {
+			util.UserError(w, fmt.Sprintf("Provided invalid mailing list: %s", listName))
+			return
+		}
+		email := util.FormValue(r, "email")
+		log.Info().Msgf("Removing %s from list %d", email, listID)
+		if err = ds.Unsubscribe(listID, email, removedByAdmin); err != nil {
+			util.ServerError(w, err)
+			return
+		}
+		http.Redirect(w, r, listDisplayLink(listName), http.StatusSeeOther)
+	})
+}
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"encoding/json"
 	"io"
 	"net/http"
 	"os"
@@ -31,6 +32,13 @@ func FormValue(r *http.Request, name string) string {
 	return strings.TrimSpace(r.FormValue(name))
 }
 
+func WriteJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error().Err(err).Msg("Could not encode JSON response")
+	}
+}
+
 func ServerError(w http.ResponseWriter, err error) {
 	log.Error().Err(err).Msg("Server Error")
 	requestError(w, http.StatusInternalServerError, err.Error())
@@ -48,6 +56,10 @@ func Forbidden(w http.ResponseWriter, msg string) {
 	requestError(w, http.StatusForbidden, msg)
 }
 
+func TooManyRequests(w http.ResponseWriter, msg string) {
+	requestError(w, http.StatusTooManyRequests, msg)
+}
+
 func GoBackWhereYouCameFrom(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, r.Header.Get("Referer"), http.StatusFound)
 }
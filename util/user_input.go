@@ -6,7 +6,11 @@ import (
 	"net/mail"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
 )
 
 func StringIsNo(s string) bool {
@@ -46,6 +50,11 @@ func GetEnvOrPanic(s string) string {
 	return e
 }
 
+// NormalizeEmail is how we tell whether two addresses are the same.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
 func IsEmailValid(email string) bool {
 	_, err := mail.ParseAddress(email)
 	return err == nil
@@ -56,3 +65,42 @@ var WhitespaceRegexp = regexp.MustCompile(`\s`)
 func ReplaceWhitespaceWith(s string, rep string) string {
 	return WhitespaceRegexp.ReplaceAllString(s, rep)
 }
+
+func GetenvIntOr(s string, fallback int) int {
+	r := os.Getenv(s)
+	if r == "" {
+		return fallback
+	}
+	i, err := strconv.Atoi(r)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Ignoring invalid integer in %s", s)
+		return fallback
+	}
+	return i
+}
+
+func GetenvDurationOr(s string, fallback time.Duration) time.Duration {
+	r := os.Getenv(s)
+	if r == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(r)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Ignoring invalid duration in %s", s)
+		return fallback
+	}
+	return d
+}
+
+func GetenvFloatOr(s string, fallback float64) float64 {
+	r := os.Getenv(s)
+	if r == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(r, 64)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Ignoring invalid number in %s", s)
+		return fallback
+	}
+	return f
+}